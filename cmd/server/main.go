@@ -2,14 +2,21 @@ package main
 
 import (
 	"context"
+	"expvar"
 	"flag"
+	"go-chat/internal/broker"
 	"go-chat/internal/chat"
 	"go-chat/internal/db"
 	myMiddleware "go-chat/internal/middleware"
+	"go-chat/internal/presence"
+	"go-chat/internal/storage"
 	"go-chat/internal/user"
 	"log"
 	"net/http"
 	"os"
+	"runtime"
+	"strconv"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
@@ -37,6 +44,81 @@ func main() {
 		redisAddr = "localhost:6379"
 	}
 
+	// How long senders may "delete for everyone" (Go duration, "0" = forever)
+	deleteWindow := time.Hour
+	if raw := os.Getenv("DELETE_FOR_EVERYONE_WINDOW"); raw != "" {
+		d, err := time.ParseDuration(raw)
+		// Compared at millisecond precision; anything shorter would read as "forever"
+		if err != nil || d < 0 || (d > 0 && d < time.Millisecond) {
+			log.Fatalf("❌ Invalid DELETE_FOR_EVERYONE_WINDOW %q", raw)
+		}
+		deleteWindow = d
+	}
+
+	// Cross-node delivery: "pubsub" (Redis, fire and forget), "streams" (Redis,
+	// survives blips), "nats", or "memory" (single node only)
+	transport := os.Getenv("TRANSPORT")
+	if transport == "" {
+		transport = "pubsub"
+	}
+
+	natsURL := os.Getenv("NATS_URL")
+	if natsURL == "" {
+		natsURL = "nats://localhost:4222"
+	}
+
+	// Streams need a stable name per node for its consumer group
+	nodeID := os.Getenv("NODE_ID")
+	if nodeID == "" {
+		nodeID, _ = os.Hostname()
+	}
+
+	// Entries kept per user stream
+	streamMaxLen := int64(1000)
+	if raw := os.Getenv("STREAM_MAXLEN"); raw != "" {
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || n < 1 {
+			log.Fatalf("❌ Invalid STREAM_MAXLEN %q", raw)
+		}
+		streamMaxLen = n
+	}
+
+	// Goroutines writing messages to Postgres (each owns a share of the conversations)
+	persistWorkers := chat.DefaultPersistWorkers
+	if raw := os.Getenv("PERSIST_WORKERS"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 {
+			log.Fatalf("❌ Invalid PERSIST_WORKERS %q", raw)
+		}
+		persistWorkers = n
+	}
+
+	// Independent routing loops in the Hub (connections are split by user ID)
+	hubShards := runtime.NumCPU()
+	if raw := os.Getenv("HUB_SHARDS"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 {
+			log.Fatalf("❌ Invalid HUB_SHARDS %q", raw)
+		}
+		hubShards = n
+	}
+
+	// How many conversation rosters each node keeps in memory
+	participantCacheSize := chat.DefaultParticipantCacheSize
+	if raw := os.Getenv("PARTICIPANT_CACHE_SIZE"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 {
+			log.Fatalf("❌ Invalid PARTICIPANT_CACHE_SIZE %q", raw)
+		}
+		participantCacheSize = n
+	}
+
+	// Where uploaded files go: "local" (dev, one node) or "s3" (MinIO, AWS, ...)
+	blobBackend := os.Getenv("BLOB_STORE")
+	if blobBackend == "" {
+		blobBackend = "local"
+	}
+
 	// 2. Connect to Database (Platform Layer)
 	database, err := db.NewDatabase(dsn)
 	if err != nil {
@@ -58,6 +140,35 @@ func main() {
 	}
 	log.Println("✅ Connected to Redis")
 
+	// Connect to Blob Storage (Platform Layer)
+	var blobs storage.BlobStore
+	switch blobBackend {
+	case "local":
+		dir := os.Getenv("BLOB_DIR")
+		if dir == "" {
+			dir = "./data/blobs"
+		}
+		blobs, err = storage.NewLocalStore(dir)
+	case "s3":
+		bucket := os.Getenv("S3_BUCKET")
+		if bucket == "" {
+			bucket = "chat-attachments"
+		}
+		blobs, err = storage.NewS3Store(context.Background(), storage.S3Config{
+			Endpoint:  os.Getenv("S3_ENDPOINT"),
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+			Bucket:    bucket,
+			UseSSL:    os.Getenv("S3_USE_SSL") == "true",
+		})
+	default:
+		log.Fatalf("❌ Unknown BLOB_STORE %q (want local or s3)", blobBackend)
+	}
+	if err != nil {
+		log.Fatalf("❌ Failed to open %s blob store: %v", blobBackend, err)
+	}
+	log.Printf("✅ Blob storage ready (%s)", blobBackend)
+
 	// 4. Initialize User Feature
 	// User Repo still uses the raw SQL connection (assuming you didn't change user/repository.go)
 	userRepo := user.NewRepository(database.Conn)
@@ -68,15 +179,54 @@ func main() {
 	// 🟢 UDPATE 1: ChatRepo now takes the *db.Database wrapper (to access Conn)
 	chatRepo := chat.NewRepository(database.Conn)
 
-	// Hub needs Redis + Repo (to fetch participants)
-	hub := chat.NewHub(redisClient, chatRepo)
+	// Rosters are cached here and in Redis; membership changes invalidate them on every node
+	participants := chat.NewParticipantCache(chatRepo, redisClient, participantCacheSize)
+	go participants.ListenForInvalidations()
+
+	// One membership check shared by the WS and REST paths
+	chatAuthz := chat.NewAuthorizer(participants)
+
+	// Cluster-wide "who is online" lives in Redis
+	presenceRegistry := presence.NewRegistry(redisClient, presence.DefaultTTL)
+	// Lookups are limited to the caller's contacts
+	presenceHandler := presence.NewHandler(presenceRegistry, chatRepo)
+
+	// How frames get to whichever node a user is connected to
+	var msgBroker broker.Broker
+	switch transport {
+	case "pubsub":
+		msgBroker = broker.NewRedisPubSub(redisClient)
+	case "streams":
+		msgBroker = broker.NewRedisStreams(redisClient, nodeID, streamMaxLen)
+	case "nats":
+		msgBroker, err = broker.NewNATS(natsURL)
+		if err != nil {
+			log.Fatalf("❌ Failed to connect to NATS: %v", err)
+		}
+	case "memory":
+		msgBroker = broker.NewMemory()
+	default:
+		log.Fatalf("❌ Unknown TRANSPORT %q (want pubsub, streams, nats or memory)", transport)
+	}
+	defer msgBroker.Close()
+	log.Printf("✅ Cross-node delivery via %s (node %s)", transport, nodeID)
+
+	// Hub needs the Broker + Repo (to fetch participants)
+	hub := chat.NewHub(msgBroker, chatRepo, chatAuthz, presenceRegistry, hubShards)
+	hub.DeleteWindow = deleteWindow
 
 	// Start the Hub Engines
+	hub.StartPersistence(persistWorkers)
 	go hub.Run()
-	go hub.SubscribeToRedis()
+	log.Printf("✅ Hub routing on %d shards", hubShards)
+	go hub.SubscribeToBroker()
+
+	// Image previews render in the background
+	thumbnailer := chat.NewThumbnailer(chatRepo, blobs, hub)
+	go thumbnailer.Run()
 
 	// 🟢 UPDATE 2: ChatHandler now needs Repo (for API) + Hub (for WS)
-	chatHandler := chat.NewHandler(hub, chatRepo)
+	chatHandler := chat.NewHandler(hub, chatRepo, chatAuthz, blobs, thumbnailer)
 
 	authMiddleware := myMiddleware.NewAuthMiddleware(userService)
 
@@ -96,13 +246,39 @@ func main() {
 	r.Group(func(r chi.Router) {
 		r.Use(authMiddleware.Handle)
 		r.Get("/api/users/search", userHandler.SearchUsers)
+		r.Get("/api/users/{id}/presence", presenceHandler.GetPresence)
+
+		// Runtime counters (participant_cache hit rate, memstats); not for the public
+		r.Handle("/debug/vars", expvar.Handler())
 
 		// WebSocket (Real-time)
 		r.Get("/ws", chatHandler.ServeWs)
 
 		// 🟢 UPDATE 3: New REST API Routes for "WhatsApp" flow
-		r.Post("/api/conversations", chatHandler.StartConversation) // Find/Create Chat
-		r.Get("/api/messages", chatHandler.GetChatHistory)          // Load History
+		r.Post("/api/conversations", chatHandler.StartConversation)              // Find/Create Chat
+		r.Get("/api/conversations", chatHandler.ListConversations)               // Inbox
+		r.Get("/api/messages", chatHandler.GetChatHistory)                       // Load History
+		r.Get("/api/messages/search", chatHandler.SearchMessages)                // Full-Text Search
+		r.Post("/api/conversations/{id}/read", chatHandler.MarkConversationRead) // Move Read Pointer
+
+		// Message Actions
+		r.Patch("/api/messages/{id}", chatHandler.EditMessage)
+		r.Get("/api/messages/{id}/edits", chatHandler.GetMessageEdits)
+		r.Delete("/api/messages/{id}", chatHandler.DeleteMessage)
+		r.Post("/api/messages/{id}/reactions", chatHandler.SetReaction)
+		r.Delete("/api/messages/{id}/reactions", chatHandler.SetReaction)
+		r.Get("/api/messages/{id}/thread", chatHandler.GetThread)
+
+		// Attachments
+		r.Post("/api/conversations/{id}/attachments", chatHandler.UploadAttachment)
+		r.Get("/api/attachments/{id}", chatHandler.DownloadAttachment)
+		r.Get("/api/attachments/{id}/thumbnails/{size}", chatHandler.DownloadThumbnail)
+
+		// Group Management
+		r.Post("/api/conversations/groups", chatHandler.CreateGroup)
+		r.Post("/api/conversations/{id}/participants", chatHandler.AddParticipants)
+		r.Delete("/api/conversations/{id}/participants/{userID}", chatHandler.RemoveParticipant)
+		r.Post("/api/conversations/{id}/leave", chatHandler.LeaveConversation)
 	})
 
 	log.Printf("🚀 Server starting on %s", *addr)
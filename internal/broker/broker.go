@@ -0,0 +1,24 @@
+// Package broker carries frames between app nodes. Every user has one topic;
+// a node subscribes to the topics of the users connected to it and hands
+// whatever arrives to its local clients.
+package broker
+
+import "context"
+
+// Delivery is one frame for one user, received on this node.
+type Delivery struct {
+	UserID  int
+	Payload []byte
+}
+
+// Broker is the cross-node transport used by chat.Hub.
+type Broker interface {
+	// Publish sends a frame to every node subscribed to the user.
+	Publish(ctx context.Context, userID int, payload []byte) error
+	// Subscribe starts delivering the user's frames to this node.
+	Subscribe(ctx context.Context, userID int) error
+	Unsubscribe(ctx context.Context, userID int) error
+	// Deliveries yields frames for subscribed users, in order per user.
+	Deliveries() <-chan Delivery
+	Close() error
+}
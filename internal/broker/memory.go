@@ -0,0 +1,107 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// Frames waiting for the Hub to take them. Past this Publish drops the frame.
+const memoryQueueSize = 8192
+
+var ErrQueueFull = errors.New("broker queue is full, frame dropped")
+
+// Memory is an in-process broker for a single node (and tests): a frame is
+// delivered if its user is subscribed, otherwise dropped, like pub/sub.
+//
+// Publish never blocks: the Hub's loops publish too, so waiting on whoever
+// consumes deliveries could deadlock. Frames queue up here instead, up to
+// memoryQueueSize; beyond that they are dropped with ErrQueueFull.
+type Memory struct {
+	mu     sync.Mutex
+	users  map[int]bool
+	queue  []Delivery
+	closed bool
+
+	wake chan struct{} // Something was queued (or Close was called)
+	out  chan Delivery
+}
+
+func NewMemory() *Memory {
+	b := &Memory{
+		users: make(map[int]bool),
+		wake:  make(chan struct{}, 1),
+		out:   make(chan Delivery),
+	}
+	go b.run()
+	return b
+}
+
+func (b *Memory) run() {
+	defer close(b.out)
+	for range b.wake {
+		for {
+			b.mu.Lock()
+			if b.closed {
+				b.mu.Unlock()
+				return
+			}
+			if len(b.queue) == 0 {
+				b.mu.Unlock()
+				break
+			}
+			next := b.queue[0]
+			b.queue[0] = Delivery{}
+			b.queue = b.queue[1:]
+			b.mu.Unlock()
+
+			b.out <- next
+		}
+	}
+}
+
+func (b *Memory) Publish(ctx context.Context, userID int, payload []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed || !b.users[userID] {
+		return nil
+	}
+	if len(b.queue) >= memoryQueueSize {
+		return ErrQueueFull
+	}
+	b.queue = append(b.queue, Delivery{UserID: userID, Payload: payload})
+	b.signal()
+	return nil
+}
+
+func (b *Memory) Subscribe(ctx context.Context, userID int) error {
+	b.mu.Lock()
+	b.users[userID] = true
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *Memory) Unsubscribe(ctx context.Context, userID int) error {
+	b.mu.Lock()
+	delete(b.users, userID)
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *Memory) Deliveries() <-chan Delivery { return b.out }
+
+func (b *Memory) Close() error {
+	b.mu.Lock()
+	b.closed = true
+	b.signal()
+	b.mu.Unlock()
+	return nil
+}
+
+// signal wakes run without blocking; one pending wake-up is enough.
+func (b *Memory) signal() {
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+}
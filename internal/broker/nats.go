@@ -0,0 +1,103 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Frames one user's subscription may buffer while the Hub is behind. Beyond
+// that the client drops them (a "slow consumer"), which ErrorHandler logs.
+const (
+	natsPendingMsgs  = 4096
+	natsPendingBytes = 16 << 20
+)
+
+// NATS publishes on one subject per user ("user.{id}"). Like Redis pub/sub
+// it is fire and forget, but the client reconnects and resubscribes by itself.
+type NATS struct {
+	conn *nats.Conn
+
+	mu   sync.Mutex
+	subs map[int]*nats.Subscription
+	out  chan Delivery
+}
+
+func NewNATS(url string) (*NATS, error) {
+	conn, err := nats.Connect(url, nats.Name("go-chat"), nats.MaxReconnects(-1), nats.ErrorHandler(logNATSError))
+	if err != nil {
+		return nil, fmt.Errorf("nats connect: %w", err)
+	}
+	return &NATS{
+		conn: conn,
+		subs: make(map[int]*nats.Subscription),
+		out:  make(chan Delivery),
+	}, nil
+}
+
+// logNATSError reports async errors, most importantly frames dropped because
+// a subscription's pending buffer was full.
+func logNATSError(_ *nats.Conn, sub *nats.Subscription, err error) {
+	if sub != nil && errors.Is(err, nats.ErrSlowConsumer) {
+		dropped, _ := sub.Dropped()
+		log.Printf("⚠️ NATS slow consumer on %s: %d frames dropped so far", sub.Subject, dropped)
+		return
+	}
+	log.Printf("❌ NATS error: %v", err)
+}
+
+func natsSubject(userID int) string {
+	return fmt.Sprintf("user.%d", userID)
+}
+
+func (b *NATS) Publish(ctx context.Context, userID int, payload []byte) error {
+	return b.conn.Publish(natsSubject(userID), payload)
+}
+
+func (b *NATS) Subscribe(ctx context.Context, userID int) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subs[userID] != nil {
+		return nil
+	}
+
+	// Each subscription gets its own goroutine from the client, so frames of
+	// one user stay in order
+	sub, err := b.conn.Subscribe(natsSubject(userID), func(m *nats.Msg) {
+		b.out <- Delivery{UserID: userID, Payload: m.Data}
+	})
+	if err != nil {
+		return err
+	}
+	if err := sub.SetPendingLimits(natsPendingMsgs, natsPendingBytes); err != nil {
+		sub.Unsubscribe()
+		return err
+	}
+	b.subs[userID] = sub
+	return nil
+}
+
+func (b *NATS) Unsubscribe(ctx context.Context, userID int) error {
+	b.mu.Lock()
+	sub := b.subs[userID]
+	delete(b.subs, userID)
+	b.mu.Unlock()
+
+	if sub == nil {
+		return nil
+	}
+	return sub.Unsubscribe()
+}
+
+func (b *NATS) Deliveries() <-chan Delivery { return b.out }
+
+// Close drops the connection. Deliveries is left open: a subscription
+// callback may still be handing over its last frame.
+func (b *NATS) Close() error {
+	b.conn.Close()
+	return nil
+}
@@ -0,0 +1,56 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisPubSub publishes on one channel per user ("user:{id}"). Fire and
+// forget: a node that is disconnected when a frame is published never sees it.
+type RedisPubSub struct {
+	redis  *redis.Client
+	pubsub *redis.PubSub
+	out    chan Delivery
+}
+
+func NewRedisPubSub(redisClient *redis.Client) *RedisPubSub {
+	b := &RedisPubSub{
+		// Start with NO subscriptions. Users are added as they connect.
+		redis:  redisClient,
+		pubsub: redisClient.Subscribe(context.Background()),
+		out:    make(chan Delivery),
+	}
+	go b.run()
+	return b
+}
+
+func (b *RedisPubSub) run() {
+	defer close(b.out)
+	for msg := range b.pubsub.Channel() {
+		var userID int
+		if n, _ := fmt.Sscanf(msg.Channel, "user:%d", &userID); n == 1 {
+			b.out <- Delivery{UserID: userID, Payload: []byte(msg.Payload)}
+		}
+	}
+}
+
+func (b *RedisPubSub) Publish(ctx context.Context, userID int, payload []byte) error {
+	return b.redis.Publish(ctx, fmt.Sprintf("user:%d", userID), payload).Err()
+}
+
+func (b *RedisPubSub) Subscribe(ctx context.Context, userID int) error {
+	return b.pubsub.Subscribe(ctx, fmt.Sprintf("user:%d", userID))
+}
+
+func (b *RedisPubSub) Unsubscribe(ctx context.Context, userID int) error {
+	return b.pubsub.Unsubscribe(ctx, fmt.Sprintf("user:%d", userID))
+}
+
+func (b *RedisPubSub) Deliveries() <-chan Delivery { return b.out }
+
+// Close stops listening. The Redis client itself is shared and stays open.
+func (b *RedisPubSub) Close() error {
+	return b.pubsub.Close()
+}
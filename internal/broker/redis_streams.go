@@ -0,0 +1,260 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// How long one XREADGROUP waits for new entries. Short, so users who
+	// connect in the meantime are included in the next read quickly.
+	streamBlock = 500 * time.Millisecond
+	// Entries fetched per stream per read
+	streamReadCount = 100
+	// A user's stream expires this long after the last frame was added to it
+	streamTTL = 24 * time.Hour
+	// Wait before retrying after Redis errors
+	streamRetryDelay = time.Second
+)
+
+// RedisStreams is the durable alternative to RedisPubSub.
+//
+// Every user has a stream "stream:user:{id}", capped at about maxLen entries.
+// Each node reads the streams of users connected to it through its own
+// consumer group ("node:{NODE_ID}"), and acks entries once they are handed to
+// the Hub. Redis remembers where each group stopped, so a node that loses its
+// connection for a moment picks up where it left off instead of missing frames.
+type RedisStreams struct {
+	redis  *redis.Client
+	group  string
+	node   string
+	maxLen int64
+
+	mu     sync.Mutex
+	users  map[int]bool // Streams this node is reading
+	closed bool
+
+	out chan Delivery
+}
+
+func NewRedisStreams(redisClient *redis.Client, nodeID string, maxLen int64) *RedisStreams {
+	b := &RedisStreams{
+		redis:  redisClient,
+		group:  "node:" + nodeID,
+		node:   nodeID,
+		maxLen: maxLen,
+		users:  make(map[int]bool),
+		out:    make(chan Delivery),
+	}
+	go b.run()
+	return b
+}
+
+func streamKey(userID int) string {
+	return fmt.Sprintf("stream:user:%d", userID)
+}
+
+// Publish appends a frame to the user's stream, trimming old entries.
+func (s *RedisStreams) Publish(ctx context.Context, userID int, payload []byte) error {
+	key := streamKey(userID)
+	pipe := s.redis.Pipeline()
+	pipe.XAdd(ctx, &redis.XAddArgs{
+		Stream: key,
+		MaxLen: s.maxLen,
+		Approx: true, // MAXLEN ~: trim in whole nodes, much cheaper
+		Values: map[string]interface{}{"data": payload},
+	})
+	pipe.Expire(ctx, key, streamTTL)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// Subscribe starts reading a user's stream from now on. Whatever this node's
+// group saw before (an earlier connection of the same user) is skipped: the
+// client catches up on messages through ?since= instead.
+func (s *RedisStreams) Subscribe(ctx context.Context, userID int) error {
+	key := streamKey(userID)
+	err := s.redis.XGroupCreateMkStream(ctx, key, s.group, "$").Err()
+	if err != nil && strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		err = s.redis.XGroupSetID(ctx, key, s.group, "$").Err()
+	}
+	if err != nil {
+		return err
+	}
+	// MKSTREAM may just have created it: make sure it still expires if nobody ever writes to it
+	if err := s.redis.Expire(ctx, key, streamTTL).Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.users[userID] = true
+	s.mu.Unlock()
+	return nil
+}
+
+// Unsubscribe stops reading a user's stream and drops this node's group on
+// it, so streams don't collect groups of nodes that no longer read them.
+// A later Subscribe starts from "now" anyway.
+func (s *RedisStreams) Unsubscribe(ctx context.Context, userID int) error {
+	s.mu.Lock()
+	delete(s.users, userID)
+	s.mu.Unlock()
+	return s.destroyGroup(ctx, userID)
+}
+
+func (s *RedisStreams) destroyGroup(ctx context.Context, userID int) error {
+	err := s.redis.XGroupDestroy(ctx, streamKey(userID), s.group).Err()
+	if err != nil && strings.Contains(err.Error(), "requires the key to exist") {
+		return nil // The stream expired, taking the group with it
+	}
+	return err
+}
+
+func (s *RedisStreams) Deliveries() <-chan Delivery { return s.out }
+
+// Close stops reading after the current XREADGROUP returns and drops this
+// node's groups (a node that dies without closing leaves them until the
+// streams expire). The Redis client itself is shared and stays open.
+func (s *RedisStreams) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	userIDs := make([]int, 0, len(s.users))
+	for userID := range s.users {
+		userIDs = append(userIDs, userID)
+	}
+	s.users = make(map[int]bool)
+	s.mu.Unlock()
+
+	for _, userID := range userIDs {
+		if err := s.destroyGroup(context.Background(), userID); err != nil {
+			log.Printf("❌ Failed to drop stream group for user %d: %v", userID, err)
+		}
+	}
+	return nil
+}
+
+// run reads every subscribed stream and hands entries to Deliveries, acking
+// each one afterwards. After an error it first re-reads what it had been given
+// but not acked yet, so nothing is lost; clients dedupe by message ID.
+func (s *RedisStreams) run() {
+	defer close(s.out)
+	ctx := context.Background()
+	backlog := true // Start with our unacked entries (e.g. from before a restart)
+
+	for {
+		streams, userIDs, closed := s.readArgs(backlog)
+		if closed {
+			return
+		}
+		if len(userIDs) == 0 {
+			time.Sleep(streamBlock)
+			continue
+		}
+
+		res, err := s.redis.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    s.group,
+			Consumer: s.node,
+			Streams:  streams,
+			Count:    streamReadCount,
+			Block:    streamBlock,
+		}).Result()
+		if err == redis.Nil {
+			backlog = false
+			continue // Nothing new
+		}
+		if err != nil && strings.HasPrefix(err.Error(), "NOGROUP") {
+			// A quiet user's stream expired (taking our group with it): recreate and go on
+			s.recreateGroups(ctx, userIDs)
+			continue
+		}
+		if err != nil {
+			log.Printf("❌ Stream read failed, retrying: %v", err)
+			backlog = true
+			time.Sleep(streamRetryDelay)
+			continue
+		}
+
+		more := false
+		for _, stream := range res {
+			var userID int
+			if _, err := fmt.Sscanf(stream.Stream, "stream:user:%d", &userID); err != nil {
+				continue
+			}
+			ids := make([]string, 0, len(stream.Messages))
+			for _, entry := range stream.Messages {
+				if data, ok := entry.Values["data"].(string); ok {
+					s.out <- Delivery{UserID: userID, Payload: []byte(data)}
+				}
+				ids = append(ids, entry.ID)
+			}
+			if len(ids) == 0 {
+				continue
+			}
+			more = more || len(ids) == streamReadCount
+			if err := s.redis.XAck(ctx, stream.Stream, s.group, ids...).Err(); err != nil {
+				log.Printf("❌ Failed to ack %d entries on %s: %v", len(ids), stream.Stream, err)
+			}
+		}
+		// A full backlog page may have more behind it
+		backlog = backlog && more
+	}
+}
+
+// recreateGroups puts back the group on any of these streams that lost it.
+// The stream expired since we last read it, so everything in it now is new
+// to us: start the group at "0", not "$", or entries added in between are lost.
+func (s *RedisStreams) recreateGroups(ctx context.Context, userIDs []int) {
+	for _, userID := range userIDs {
+		s.mu.Lock()
+		subscribed := s.users[userID]
+		s.mu.Unlock()
+		if !subscribed {
+			continue // Unsubscribed meanwhile: its group is meant to be gone
+		}
+
+		key := streamKey(userID)
+		err := s.redis.XGroupCreateMkStream(ctx, key, s.group, "0").Err()
+		if err != nil && strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			continue // This one still had it
+		}
+		if err == nil {
+			err = s.redis.Expire(ctx, key, streamTTL).Err()
+		}
+		if err != nil {
+			log.Printf("❌ Failed to recreate stream group for user %d: %v", userID, err)
+			time.Sleep(streamRetryDelay)
+			return
+		}
+	}
+}
+
+// readArgs builds XREADGROUP's STREAMS list: every key, then one ID per key
+// (">" for new entries, "0" for our own delivered-but-unacked ones).
+func (s *RedisStreams) readArgs(backlog bool) (keys []string, userIDs []int, closed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, nil, true
+	}
+
+	id := ">"
+	if backlog {
+		id = "0"
+	}
+	keys = make([]string, 0, len(s.users)*2)
+	userIDs = make([]int, 0, len(s.users))
+	for userID := range s.users {
+		keys = append(keys, streamKey(userID))
+		userIDs = append(userIDs, userID)
+	}
+	for range userIDs {
+		keys = append(keys, id)
+	}
+	return keys, userIDs, false
+}
@@ -0,0 +1,140 @@
+package chat
+
+import (
+	"context"
+	"strings"
+)
+
+// ---------------------------------------------
+// ✏️ Message Actions
+// ---------------------------------------------
+//
+// Operations on existing messages that both the WebSocket (Client) and the
+// REST API (Handler) expose. Each one checks access, writes through the
+// Repository, then fans the change out to the participants with publishEvent.
+
+// EditMessage replaces a message's content. Only its sender may do this, and
+// only while still a participant. The previous version goes to message_edits.
+// Saving the same content again changes nothing and tells no one.
+func (h *Hub) EditMessage(ctx context.Context, userID, messageID int, content string) (*Message, error) {
+	if strings.TrimSpace(content) == "" {
+		return nil, ErrEmptyContent
+	}
+	if len(content) > maxMessageSize {
+		return nil, ErrContentTooLong
+	}
+
+	conversationID, senderID, err := h.repo.GetMessageOwner(ctx, messageID)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.authz.RequireParticipant(ctx, conversationID, userID); err != nil {
+		return nil, err
+	}
+	if senderID != userID {
+		return nil, ErrNotSender
+	}
+
+	edited, changed, err := h.repo.EditMessage(ctx, messageID, content)
+	if err != nil {
+		return nil, err
+	}
+	if !changed {
+		return edited, nil
+	}
+
+	h.publishEvent(&Event{
+		ConversationID: conversationID,
+		Type:           FrameEdit,
+		Data:           edited,
+	})
+	return edited, nil
+}
+
+// DeleteMessage deletes a message for the caller only (DeleteForMe, any
+// participant) or for everyone (DeleteForEveryone, sender only, within
+// DeleteWindow). The resulting event is also what clients receive.
+func (h *Hub) DeleteMessage(ctx context.Context, userID, messageID int, scope string) (*DeleteEvent, error) {
+	if scope != DeleteForMe && scope != DeleteForEveryone {
+		return nil, ErrInvalidDeleteScope
+	}
+
+	conversationID, senderID, err := h.repo.GetMessageOwner(ctx, messageID)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.authz.RequireParticipant(ctx, conversationID, userID); err != nil {
+		return nil, err
+	}
+
+	ev := &DeleteEvent{MessageID: messageID, ConversationID: conversationID, Scope: scope}
+
+	if scope == DeleteForMe {
+		if err := h.repo.HideMessage(ctx, messageID, userID); err != nil {
+			return nil, err
+		}
+		// Only this user's other devices need to know
+		h.publishToUser(ctx, userID, newFrame(FrameDelete, "", ev))
+		return ev, nil
+	}
+
+	if senderID != userID {
+		return nil, ErrNotSender
+	}
+	tombstone, err := h.repo.DeleteMessageForEveryone(ctx, messageID, h.DeleteWindow)
+	if err != nil {
+		return nil, err
+	}
+	ev.DeletedAt = tombstone.DeletedAt
+
+	h.publishEvent(&Event{
+		ConversationID: conversationID,
+		Type:           FrameDelete,
+		Data:           ev,
+	})
+	return ev, nil
+}
+
+// React adds (add = true) or removes one of the caller's emoji reactions on a
+// message in a conversation they belong to. A user may put at most
+// maxReactionsPerUser different emoji on one message.
+func (h *Hub) React(ctx context.Context, userID, messageID int, emoji string, add bool) (*ReactionEvent, error) {
+	if !isEmoji(emoji) {
+		return nil, ErrInvalidEmoji
+	}
+
+	msg, err := h.repo.GetMessage(ctx, messageID)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.authz.RequireParticipant(ctx, msg.ConversationID, userID); err != nil {
+		return nil, err
+	}
+	if msg.DeletedAt != nil {
+		return nil, ErrMessageDeleted
+	}
+
+	count, err := h.repo.SetReaction(ctx, messageID, userID, emoji, add)
+	if err != nil {
+		return nil, err
+	}
+
+	ev := &ReactionEvent{
+		MessageID:      messageID,
+		ConversationID: msg.ConversationID,
+		UserID:         userID,
+		Emoji:          emoji,
+		Action:         ReactionRemove,
+		Count:          count,
+	}
+	if add {
+		ev.Action = ReactionAdd
+	}
+
+	h.publishEvent(&Event{
+		ConversationID: msg.ConversationID,
+		Type:           FrameReaction,
+		Data:           ev,
+	})
+	return ev, nil
+}
@@ -0,0 +1,257 @@
+package chat
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"go-chat/internal/media"
+	myMiddleware "go-chat/internal/middleware"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// 16. UPLOAD: "Attach this photo"
+// POST /api/conversations/{id}/attachments   (multipart/form-data, field "file")
+// Then send a message with "attachment_ids": [<id>] to share it.
+func (h *Handler) UploadAttachment(w http.ResponseWriter, r *http.Request) {
+	conversationID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid conversation id", http.StatusBadRequest)
+		return
+	}
+
+	userID, ok := r.Context().Value(myMiddleware.UserKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// A. Only participants may upload into a conversation
+	if err := h.authz.RequireParticipant(r.Context(), conversationID, userID); err != nil {
+		writeChatError(w, err)
+		return
+	}
+
+	// B. Stream the "file" part straight to storage (no temp files; leave room for multipart headers)
+	r.Body = http.MaxBytesReader(w, r.Body, MaxAttachmentSize+1<<20)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "Expected multipart/form-data", http.StatusBadRequest)
+		return
+	}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			http.Error(w, "Missing file", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Invalid multipart body", http.StatusBadRequest)
+			return
+		}
+		if part.FormName() != "file" {
+			part.Close()
+			continue
+		}
+
+		att, err := h.storeAttachment(r.Context(), conversationID, userID, part.FileName(), part)
+		part.Close()
+		if err != nil {
+			writeChatError(w, err)
+			return
+		}
+
+		log.Printf("📎 User %d uploaded attachment %d (%s, %d bytes) to conversation %d", userID, att.ID, att.MimeType, att.Size, conversationID)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(att)
+		return
+	}
+}
+
+// storeAttachment sniffs, hashes and measures the upload while writing it to
+// the BlobStore, then records it. The client's Content-Type is never trusted.
+func (h *Handler) storeAttachment(ctx context.Context, conversationID, userID int, filename string, body io.Reader) (*Attachment, error) {
+	br := bufio.NewReaderSize(body, 512)
+	head, _ := br.Peek(512)
+	mimeType := http.DetectContentType(head)
+
+	hasher := sha256.New()
+	limited := &sizeLimiter{r: br, max: MaxAttachmentSize}
+	key := fmt.Sprintf("attachments/%d/%s", conversationID, rand.Text())
+
+	if err := h.blobs.Put(ctx, key, io.TeeReader(limited, hasher), -1, mimeType); err != nil {
+		h.blobs.Delete(ctx, key) // Drop whatever part of it made it
+		if limited.n > limited.max {
+			return nil, ErrAttachmentTooLarge
+		}
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			return nil, ErrAttachmentTooLarge
+		}
+		return nil, fmt.Errorf("store attachment: %w", err)
+	}
+
+	att := &Attachment{
+		ConversationID: conversationID,
+		UploaderID:     userID,
+		Filename:       cleanFilename(filename),
+		MimeType:       mimeType,
+		Size:           limited.n,
+		SHA256:         hex.EncodeToString(hasher.Sum(nil)),
+		storageKey:     key,
+	}
+	if media.Supported(mimeType) {
+		att.ThumbnailStatus = ThumbnailPending
+	}
+
+	att, err := h.repo.CreateAttachment(ctx, att)
+	if err != nil {
+		h.blobs.Delete(ctx, key)
+		return nil, err
+	}
+
+	// 🖼️ Previews render in the background; the upload doesn't wait for them
+	if att.ThumbnailStatus == ThumbnailPending {
+		h.thumbs.Enqueue(att.ID)
+	}
+	return att, nil
+}
+
+// sizeLimiter counts what passes through and fails once more than max bytes did.
+type sizeLimiter struct {
+	r      io.Reader
+	n, max int64
+}
+
+func (l *sizeLimiter) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	if l.n > l.max {
+		return n, ErrAttachmentTooLarge
+	}
+	return n, err
+}
+
+// cleanFilename keeps only the base name the client sent, for display and downloads.
+func cleanFilename(name string) string {
+	name = strings.TrimSpace(path.Base(strings.ReplaceAll(name, `\`, "/")))
+	if name == "" || name == "." || name == "/" {
+		return "file"
+	}
+	if runes := []rune(name); len(runes) > maxFilenameLength {
+		name = string(runes[:maxFilenameLength])
+	}
+	return name
+}
+
+// 17. DOWNLOAD: "Open that photo"
+// GET /api/attachments/{id}
+func (h *Handler) DownloadAttachment(w http.ResponseWriter, r *http.Request) {
+	attachmentID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid attachment id", http.StatusBadRequest)
+		return
+	}
+
+	userID, ok := r.Context().Value(myMiddleware.UserKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// 🔒 Whoever is in the conversation now may read its files
+	att, err := h.repo.GetAttachment(r.Context(), attachmentID)
+	if err == nil {
+		err = h.authz.RequireParticipant(r.Context(), att.ConversationID, userID)
+	}
+	if err != nil {
+		writeChatError(w, err)
+		return
+	}
+
+	// Only media renders inline; everything else (HTML, SVG, ...) is forced to download
+	disposition := "attachment"
+	if strings.HasPrefix(att.MimeType, "image/") || strings.HasPrefix(att.MimeType, "video/") || strings.HasPrefix(att.MimeType, "audio/") {
+		disposition = "inline"
+	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": att.Filename}))
+	h.serveBlob(w, r, att.storageKey, att.MimeType, att.SHA256, att.Size, att.CreatedAt)
+}
+
+// 18. THUMBNAIL: "Show me a small version"
+// GET /api/attachments/{id}/thumbnails/{size}   (size: one of the attachment's "thumbnails")
+func (h *Handler) DownloadThumbnail(w http.ResponseWriter, r *http.Request) {
+	attachmentID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid attachment id", http.StatusBadRequest)
+		return
+	}
+	size, err := strconv.Atoi(chi.URLParam(r, "size"))
+	if err != nil {
+		http.Error(w, "Invalid thumbnail size", http.StatusBadRequest)
+		return
+	}
+
+	userID, ok := r.Context().Value(myMiddleware.UserKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// 🔒 Same rule as the original
+	att, err := h.repo.GetAttachment(r.Context(), attachmentID)
+	if err == nil {
+		err = h.authz.RequireParticipant(r.Context(), att.ConversationID, userID)
+	}
+	var thumb *Thumbnail
+	if err == nil {
+		thumb, err = h.repo.GetThumbnail(r.Context(), attachmentID, size)
+	}
+	if err != nil {
+		writeChatError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", "inline")
+	h.serveBlob(w, r, thumb.storageKey, "image/jpeg", fmt.Sprintf("%s-%d", att.SHA256, size), thumb.bytes, att.CreatedAt)
+}
+
+// serveBlob streams an immutable blob with caching headers. Callers have
+// already checked access and set Content-Disposition.
+func (h *Handler) serveBlob(w http.ResponseWriter, r *http.Request, key, mimeType, etag string, size int64, modTime time.Time) {
+	body, err := h.blobs.Get(r.Context(), key)
+	if err != nil {
+		log.Printf("❌ Failed to open blob %s: %v", key, err)
+		http.Error(w, "Failed to load attachment", http.StatusInternalServerError)
+		return
+	}
+	defer body.Close()
+
+	w.Header().Set("Content-Type", mimeType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("ETag", `"`+etag+`"`)
+	w.Header().Set("Cache-Control", "private, max-age=31536000, immutable") // Content never changes
+
+	// Both stores hand back seekable readers, which gets us Range and If-None-Match for free
+	if rs, ok := body.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, "", modTime, rs)
+		return
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	io.Copy(w, body)
+}
@@ -0,0 +1,31 @@
+package chat
+
+import "context"
+
+// Authorizer is the single place that decides whether a user may read from or
+// post into a conversation. Both the WebSocket path (Client.ReadPump) and the
+// REST handlers go through it.
+type Authorizer struct {
+	participants *ParticipantCache
+}
+
+func NewAuthorizer(participants *ParticipantCache) *Authorizer {
+	return &Authorizer{participants: participants}
+}
+
+// RequireParticipant returns ErrNotParticipant unless userID is currently a
+// participant of the conversation. Unknown conversations get the same error,
+// so callers can't probe which IDs exist.
+func (a *Authorizer) RequireParticipant(ctx context.Context, conversationID, userID int) error {
+	participantIDs, err := a.participants.Get(ctx, conversationID)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range participantIDs {
+		if id == userID {
+			return nil
+		}
+	}
+	return ErrNotParticipant
+}
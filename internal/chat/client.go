@@ -1,8 +1,13 @@
 package chat
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -21,16 +26,36 @@ type Client struct {
 	Send     chan []byte
 	UserID   int
 	Username string
+	ConnID   string // Identifies this connection in the presence registry
+
+	// Offline catch-up before going live: everything after SyncSeqs[conversation]
+	// in the conversations listed there, after message ID SyncSince in the rest
+	// (both empty = don't)
+	SyncSince int
+	SyncSeqs  map[int]int64
+
+	// Owned by the Hub's shard: live frames held back while catchUp runs
+	syncing bool
+	pending [][]byte
 }
 
 func (c *Client) ReadPump() {
 	defer func() {
-		c.Hub.Unregister <- c
+		c.Hub.markOffline(c)
+		c.Hub.Unregister(c)
 		c.Conn.Close()
 	}()
 	c.Conn.SetReadLimit(maxMessageSize)
 	c.Conn.SetReadDeadline(time.Now().Add(pongWait))
-	c.Conn.SetPongHandler(func(string) error { c.Conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
+	c.Conn.SetPongHandler(func(string) error {
+		c.Conn.SetReadDeadline(time.Now().Add(pongWait))
+		c.Hub.heartbeat(c)
+		return nil
+	})
+
+	if c.needsCatchUp() {
+		c.catchUp()
+	}
 
 	for {
 		_, message, err := c.Conn.ReadMessage()
@@ -41,24 +66,265 @@ func (c *Client) ReadPump() {
 			break
 		}
 
-		// 🟢 PURE JSON PARSING: Only Content and ConversationID
-		var msgReq struct {
-			Content        string `json:"content"`
-			ConversationID int    `json:"conversation_id"`
+		// 🟢 Every frame is an Envelope; dispatch on its type
+		var env Envelope
+		if err := json.Unmarshal(message, &env); err != nil {
+			c.sendFrame(newErrorFrame("", ErrCodeBadRequest, "invalid JSON envelope", 0))
+			continue
 		}
-
-		if err := json.Unmarshal(message, &msgReq); err != nil {
-			log.Printf("❌ Invalid JSON format: %v", err)
+		if env.V != ProtocolVersion {
+			c.sendFrame(newErrorFrame(env.Ref, ErrCodeUnsupportedVersion, fmt.Sprintf("protocol version %d is not supported", env.V), 0))
 			continue
 		}
 
-		// Send to Hub (Hub will figure out the recipient)
-		c.Hub.Publish <- &Message{
-			UserID:         c.UserID,
-			Username:       c.Username,
-			Content:        msgReq.Content,
-			ConversationID: msgReq.ConversationID,
+		switch env.Type {
+		case FrameMessage:
+			c.handleMessage(env)
+		case FrameReceipt:
+			c.handleReceipt(env)
+		case FrameTyping:
+			c.handleTyping(env)
+		case FrameEdit:
+			c.handleEdit(env)
+		case FrameDelete:
+			c.handleDelete(env)
+		case FrameReaction:
+			c.handleReaction(env)
+		default:
+			c.sendFrame(newErrorFrame(env.Ref, ErrCodeUnknownType, fmt.Sprintf("unsupported frame type %q", env.Type), 0))
+		}
+	}
+}
+
+// handleMessage validates an inbound chat message and hands it to the Hub.
+func (c *Client) handleMessage(env Envelope) {
+	var msgReq WSMessage
+	if err := json.Unmarshal(env.Data, &msgReq); err != nil || msgReq.ConversationID == 0 {
+		c.sendFrame(newErrorFrame(env.Ref, ErrCodeBadRequest, "message needs conversation_id and content", 0))
+		return
+	}
+	if strings.TrimSpace(msgReq.Content) == "" && len(msgReq.AttachmentIDs) == 0 {
+		c.sendFrame(newErrorFrame(env.Ref, ErrCodeBadRequest, "message content is empty", msgReq.ConversationID))
+		return
+	}
+	if len(msgReq.AttachmentIDs) > maxAttachmentsPerMessage {
+		c.sendFrame(newErrorFrame(env.Ref, ErrCodeBadRequest, fmt.Sprintf("at most %d attachments per message", maxAttachmentsPerMessage), msgReq.ConversationID))
+		return
+	}
+	if len(msgReq.ClientMsgID) > maxClientMsgIDLength {
+		c.sendFrame(newErrorFrame(env.Ref, ErrCodeBadRequest, fmt.Sprintf("client_msg_id is longer than %d bytes", maxClientMsgIDLength), msgReq.ConversationID))
+		return
+	}
+
+	// 🔒 Only participants may post into a conversation
+	if err := c.Hub.authz.RequireParticipant(context.Background(), msgReq.ConversationID, c.UserID); err != nil {
+		log.Printf("⛔ User %d rejected from conversation %d: %v", c.UserID, msgReq.ConversationID, err)
+		c.sendError(env.Ref, msgReq.ConversationID, err)
+		return
+	}
+
+	msg := &Message{
+		UserID:         c.UserID,
+		Username:       c.Username,
+		Content:        msgReq.Content,
+		ConversationID: msgReq.ConversationID,
+		ClientMsgID:    msgReq.ClientMsgID,
+		sender:         c,
+		ref:            env.Ref,
+	}
+
+	// ↩️ A reply must point at a message of the same conversation
+	if msgReq.ReplyToID != 0 {
+		parent, err := c.Hub.repo.GetMessage(context.Background(), msgReq.ReplyToID)
+		if errors.Is(err, ErrMessageNotFound) || (err == nil && parent.ConversationID != msgReq.ConversationID) {
+			err = ErrInvalidReply
 		}
+		if err != nil {
+			c.sendError(env.Ref, msgReq.ConversationID, err)
+			return
+		}
+		msg.ReplyToID = &msgReq.ReplyToID
+	}
+
+	// 📎 Attachments must be our own, uploaded here, and not sent already
+	if len(msgReq.AttachmentIDs) > 0 {
+		ids := slices.Compact(slices.Sorted(slices.Values(msgReq.AttachmentIDs)))
+		n, err := c.Hub.repo.CountUnsentAttachments(context.Background(), msgReq.ConversationID, c.UserID, ids)
+		if err == nil && n != len(ids) {
+			err = ErrInvalidAttachment
+		}
+		if err != nil {
+			c.sendError(env.Ref, msgReq.ConversationID, err)
+			return
+		}
+		msg.attachmentIDs = ids
+	}
+
+	// Queue for storage (a persist worker acks us and fans it out). A full
+	// queue blocks this connection for a moment, then tells the client to back off.
+	if err := c.Hub.persist.submit(msg); err != nil {
+		log.Printf("⏳ Persist queue full, user %d told to retry", c.UserID)
+		c.sendError(env.Ref, msgReq.ConversationID, err)
+	}
+}
+
+// handleEdit changes the content of one of our own messages.
+func (c *Client) handleEdit(env Envelope) {
+	var req WSEdit
+	if err := json.Unmarshal(env.Data, &req); err != nil || req.MessageID == 0 {
+		c.sendFrame(newErrorFrame(env.Ref, ErrCodeBadRequest, "edit needs message_id and content", 0))
+		return
+	}
+
+	edited, err := c.Hub.EditMessage(context.Background(), c.UserID, req.MessageID, req.Content)
+	if err != nil {
+		c.sendError(env.Ref, 0, err)
+		return
+	}
+
+	c.sendFrame(newFrame(FrameAck, env.Ref, AckFrame{
+		MessageID:      edited.ID,
+		ConversationID: edited.ConversationID,
+		Seq:            edited.Seq,
+		CreatedAt:      edited.CreatedAt,
+	}))
+}
+
+// handleDelete deletes a message for us, or (our own, recent ones) for everyone.
+func (c *Client) handleDelete(env Envelope) {
+	var req WSDelete
+	if err := json.Unmarshal(env.Data, &req); err != nil || req.MessageID == 0 {
+		c.sendFrame(newErrorFrame(env.Ref, ErrCodeBadRequest, "delete needs message_id and scope", 0))
+		return
+	}
+
+	ev, err := c.Hub.DeleteMessage(context.Background(), c.UserID, req.MessageID, req.Scope)
+	if err != nil {
+		c.sendError(env.Ref, 0, err)
+		return
+	}
+
+	c.sendFrame(newFrame(FrameAck, env.Ref, AckFrame{
+		MessageID:      ev.MessageID,
+		ConversationID: ev.ConversationID,
+	}))
+}
+
+// handleReaction adds or removes one of our emoji reactions.
+func (c *Client) handleReaction(env Envelope) {
+	var req WSReaction
+	if err := json.Unmarshal(env.Data, &req); err != nil || req.MessageID == 0 ||
+		(req.Action != ReactionAdd && req.Action != ReactionRemove) {
+		c.sendFrame(newErrorFrame(env.Ref, ErrCodeBadRequest, "reaction needs message_id, emoji and action 'add' or 'remove'", 0))
+		return
+	}
+
+	ev, err := c.Hub.React(context.Background(), c.UserID, req.MessageID, req.Emoji, req.Action == ReactionAdd)
+	if err != nil {
+		c.sendError(env.Ref, 0, err)
+		return
+	}
+
+	c.sendFrame(newFrame(FrameAck, env.Ref, AckFrame{
+		MessageID:      ev.MessageID,
+		ConversationID: ev.ConversationID,
+	}))
+}
+
+// handleTyping forwards a typing indicator to the Hub. Typing is ephemeral:
+// it never goes near SaveMessage or the messages table.
+func (c *Client) handleTyping(env Envelope) {
+	var req WSTyping
+	if err := json.Unmarshal(env.Data, &req); err != nil || req.ConversationID == 0 ||
+		(req.State != TypingStarted && req.State != TypingStopped) {
+		c.sendFrame(newErrorFrame(env.Ref, ErrCodeBadRequest, "typing needs conversation_id and state 'started' or 'stopped'", 0))
+		return
+	}
+
+	if err := c.Hub.authz.RequireParticipant(context.Background(), req.ConversationID, c.UserID); err != nil {
+		c.sendError(env.Ref, req.ConversationID, err)
+		return
+	}
+
+	c.Hub.shardFor(c.UserID).typingIn <- &typingUpdate{
+		client:         c,
+		conversationID: req.ConversationID,
+		typing:         req.State == TypingStarted,
+	}
+}
+
+// handleReceipt records a delivered/read acknowledgement and tells the
+// conversation about it (so the sender's ticks update on all their devices).
+func (c *Client) handleReceipt(env Envelope) {
+	var req WSReceipt
+	if err := json.Unmarshal(env.Data, &req); err != nil || req.MessageID == 0 ||
+		(req.Status != ReceiptDelivered && req.Status != ReceiptRead) {
+		c.sendFrame(newErrorFrame(env.Ref, ErrCodeBadRequest, "receipt needs message_id and status 'delivered' or 'read'", 0))
+		return
+	}
+
+	ctx := context.Background()
+	conversationID, senderID, err := c.Hub.repo.GetMessageOwner(ctx, req.MessageID)
+	if err == nil {
+		err = c.Hub.authz.RequireParticipant(ctx, conversationID, c.UserID)
+	}
+	if err == nil && senderID == c.UserID {
+		err = ErrOwnMessage
+	}
+	if err != nil {
+		c.sendError(env.Ref, conversationID, err)
+		return
+	}
+
+	receipt, err := c.Hub.repo.MarkReceipt(ctx, req.MessageID, c.UserID, req.Status)
+	if err != nil {
+		c.sendError(env.Ref, conversationID, err)
+		return
+	}
+	receipt.ConversationID = conversationID
+
+	// Reading a message also moves the inbox read pointer
+	if req.Status == ReceiptRead {
+		if err := c.Hub.repo.MarkConversationRead(ctx, conversationID, c.UserID, req.MessageID); err != nil {
+			log.Printf("❌ Failed to move read pointer: %v", err)
+		}
+	}
+
+	c.Hub.publishEvent(&Event{
+		ConversationID: conversationID,
+		Type:           FrameReceipt,
+		Data:           receipt,
+	})
+}
+
+// sendError tells this client (and only this client) why its request was rejected.
+func (c *Client) sendError(ref string, conversationID int, err error) {
+	switch {
+	case errors.Is(err, ErrBusy):
+		c.sendFrame(newErrorFrame(ref, ErrCodeBusy, err.Error(), conversationID))
+	case errors.Is(err, ErrNotParticipant), errors.Is(err, ErrNotAdmin), errors.Is(err, ErrNotSender),
+		errors.Is(err, ErrDeleteWindowExpired):
+		c.sendFrame(newErrorFrame(ref, ErrCodeForbidden, err.Error(), conversationID))
+	case errors.Is(err, ErrMessageNotFound), errors.Is(err, ErrConversationNotFound):
+		c.sendFrame(newErrorFrame(ref, ErrCodeNotFound, err.Error(), conversationID))
+	case errors.Is(err, ErrOwnMessage), errors.Is(err, ErrEmptyContent), errors.Is(err, ErrContentTooLong), errors.Is(err, ErrInvalidDeleteScope),
+		errors.Is(err, ErrMessageDeleted), errors.Is(err, ErrInvalidEmoji), errors.Is(err, ErrTooManyReactions), errors.Is(err, ErrInvalidReply),
+		errors.Is(err, ErrInvalidAttachment):
+		c.sendFrame(newErrorFrame(ref, ErrCodeBadRequest, err.Error(), conversationID))
+	default:
+		log.Printf("❌ WS request failed: %v", err)
+		c.sendFrame(newErrorFrame(ref, ErrCodeInternal, "internal server error", conversationID))
+	}
+}
+
+// sendFrame queues a payload for this client from its own ReadPump goroutine.
+// Send is only closed after ReadPump exits, so this never hits a closed channel.
+func (c *Client) sendFrame(payload []byte) {
+	select {
+	case c.Send <- payload:
+	default:
+		// Buffer full: the client is not draining, same treatment as in the Hub
+		c.Conn.Close()
 	}
 }
 
@@ -0,0 +1,106 @@
+package chat
+
+import "unicode/utf8"
+
+const (
+	// Generous for the longest standard ZWJ sequences (~35 bytes, 10 code points;
+	// message_reactions.emoji holds 32 characters)
+	maxEmojiBytes = 64
+	// Different emoji one user may put on one message
+	maxReactionsPerUser = 10
+)
+
+// Code points that combine with an emoji instead of standing alone
+const (
+	zwj               = '\u200D'
+	variationText     = '\uFE0E'
+	variationEmoji    = '\uFE0F'
+	keycapMark        = '\u20E3'
+	tagCancel         = '\U000E007F'
+	blackFlag         = '\U0001F3F4'
+	skinToneFirst     = '\U0001F3FB'
+	skinToneLast      = '\U0001F3FF'
+	regionalFirst     = '\U0001F1E6'
+	regionalLast      = '\U0001F1FF'
+	tagFirst, tagLast = '\U000E0020', '\U000E007E'
+)
+
+// pictographic approximates Unicode's Extended_Pictographic property: the
+// code points that can start (or be joined into) an emoji.
+var pictographic = [][2]rune{
+	{0x00A9, 0x00A9}, {0x00AE, 0x00AE}, {0x203C, 0x203C}, {0x2049, 0x2049},
+	{0x2122, 0x2122}, {0x2139, 0x2139}, {0x2194, 0x2199}, {0x21A9, 0x21AA},
+	{0x231A, 0x231B}, {0x2328, 0x2328}, {0x23CF, 0x23CF}, {0x23E9, 0x23F3},
+	{0x23F8, 0x23FA}, {0x24C2, 0x24C2}, {0x25AA, 0x25AB}, {0x25B6, 0x25B6},
+	{0x25C0, 0x25C0}, {0x25FB, 0x25FE}, {0x2600, 0x27BF}, {0x2934, 0x2935},
+	{0x2B05, 0x2B07}, {0x2B1B, 0x2B1C}, {0x2B50, 0x2B50}, {0x2B55, 0x2B55},
+	{0x3030, 0x3030}, {0x303D, 0x303D}, {0x3297, 0x3297}, {0x3299, 0x3299},
+	{0x1F000, 0x1F1E5}, {0x1F200, 0x1F3FA}, {0x1F400, 0x1FAFF}, {0x1FC00, 0x1FFFD},
+}
+
+func isPictographic(r rune) bool {
+	for _, rng := range pictographic {
+		if r >= rng[0] && r <= rng[1] {
+			return true
+		}
+	}
+	return false
+}
+
+func isRegional(r rune) bool { return r >= regionalFirst && r <= regionalLast }
+
+// isEmoji reports whether s is exactly one emoji as users see it: a
+// pictograph with optional presentation selector and skin tone, several of
+// those joined by ZWJ (👩‍💻), a flag (🇩🇪, 🏴󠁧󠁢󠁳󠁣󠁴󠁿) or a keycap (1️⃣).
+func isEmoji(s string) bool {
+	if s == "" || len(s) > maxEmojiBytes || !utf8.ValidString(s) {
+		return false
+	}
+	rs := []rune(s)
+
+	// Country flag: exactly two regional indicators
+	if isRegional(rs[0]) {
+		return len(rs) == 2 && isRegional(rs[1])
+	}
+
+	// Keycap: digit, # or *, optional FE0F, then U+20E3
+	if r := rs[0]; r == '#' || r == '*' || (r >= '0' && r <= '9') {
+		rest := rs[1:]
+		if len(rest) > 0 && rest[0] == variationEmoji {
+			rest = rest[1:]
+		}
+		return len(rest) == 1 && rest[0] == keycapMark
+	}
+
+	// Subdivision flag: black flag, tag letters, cancel tag
+	if rs[0] == blackFlag && len(rs) > 2 && rs[len(rs)-1] == tagCancel {
+		for _, r := range rs[1 : len(rs)-1] {
+			if r < tagFirst || r > tagLast {
+				return false
+			}
+		}
+		return true
+	}
+
+	// Pictographs joined by ZWJ, each with optional selector and skin tone
+	i := 0
+	for {
+		if i >= len(rs) || !isPictographic(rs[i]) {
+			return false
+		}
+		i++
+		if i < len(rs) && (rs[i] == variationEmoji || rs[i] == variationText) {
+			i++
+		}
+		if i < len(rs) && rs[i] >= skinToneFirst && rs[i] <= skinToneLast {
+			i++
+		}
+		if i == len(rs) {
+			return true
+		}
+		if rs[i] != zwj {
+			return false
+		}
+		i++
+	}
+}
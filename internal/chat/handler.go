@@ -2,13 +2,17 @@ package chat
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
 
 	myMiddleware "go-chat/internal/middleware" // Check your import path!
+	"go-chat/internal/storage"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/gorilla/websocket"
 )
 
@@ -22,14 +26,20 @@ var upgrader = websocket.Upgrader{
 
 // Handler now needs the Repo to save/fetch chats
 type Handler struct {
-	hub  *Hub
-	repo *Repository
+	hub    *Hub
+	repo   *Repository
+	authz  *Authorizer
+	blobs  storage.BlobStore
+	thumbs *Thumbnailer
 }
 
-func NewHandler(hub *Hub, repo *Repository) *Handler {
+func NewHandler(hub *Hub, repo *Repository, authz *Authorizer, blobs storage.BlobStore, thumbs *Thumbnailer) *Handler {
 	return &Handler{
-		hub:  hub,
-		repo: repo,
+		hub:    hub,
+		repo:   repo,
+		authz:  authz,
+		blobs:  blobs,
+		thumbs: thumbs,
 	}
 }
 
@@ -69,7 +79,8 @@ func (h *Handler) StartConversation(w http.ResponseWriter, r *http.Request) {
 }
 
 // 2. GET HISTORY: "Show me messages for Room 101"
-// GET /api/conversations/{id}/messages
+// GET /api/messages?conversation_id=101&before=&after=&before_seq=&after_seq=&limit=
+// Returns the newest page first plus a next_cursor to keep scrolling.
 func (h *Handler) GetChatHistory(w http.ResponseWriter, r *http.Request) {
 	// A. Parse Conversation ID from Query Params or URL
 	// Assuming URL: /api/messages?conversation_id=101
@@ -80,16 +91,67 @@ func (h *Handler) GetChatHistory(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// B. Fetch from Repo
-	messages, err := h.repo.GetConversationMessages(r.Context(), conversationID)
+	page, err := parseMessagePage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// B. Only participants may read a conversation
+	userID, ok := r.Context().Value(myMiddleware.UserKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if err := h.authz.RequireParticipant(r.Context(), conversationID, userID); err != nil {
+		writeChatError(w, err)
+		return
+	}
+
+	// C. Fetch from Repo
+	history, err := h.repo.GetConversationMessages(r.Context(), conversationID, userID, page)
 	if err != nil {
 		http.Error(w, "Failed to fetch messages", http.StatusInternalServerError)
 		return
 	}
 
-	// C. Return JSON
+	// D. Return JSON
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(messages)
+	json.NewEncoder(w).Encode(history)
+}
+
+// parseMessagePage reads ?before=, ?after=, ?before_seq=, ?after_seq= and ?limit= (all optional).
+func parseMessagePage(r *http.Request) (MessagePage, error) {
+	page := MessagePage{Limit: DefaultPageSize}
+	q := r.URL.Query()
+
+	for name, dst := range map[string]*int{"before": &page.Before, "after": &page.After, "limit": &page.Limit} {
+		raw := q.Get(name)
+		if raw == "" {
+			continue
+		}
+		v, err := strconv.Atoi(raw)
+		if err != nil || v < 0 {
+			return page, fmt.Errorf("invalid %s", name)
+		}
+		*dst = v
+	}
+	for name, dst := range map[string]*int64{"before_seq": &page.BeforeSeq, "after_seq": &page.AfterSeq} {
+		raw := q.Get(name)
+		if raw == "" {
+			continue
+		}
+		v, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || v < 0 {
+			return page, fmt.Errorf("invalid %s", name)
+		}
+		*dst = v
+	}
+
+	if page.Limit < 1 || page.Limit > MaxPageSize {
+		return page, fmt.Errorf("limit must be between 1 and %d", MaxPageSize)
+	}
+	return page, nil
 }
 
 // 3. WEBSOCKET: "Connect me to the real-time stream"
@@ -102,6 +164,23 @@ func (h *Handler) ServeWs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Reconnecting? "?since=<last message ID I saw>" replays what we missed.
+	since := 0
+	if raw := r.URL.Query().Get("since"); raw != "" {
+		v, err := strconv.Atoi(raw)
+		if err != nil || v < 0 {
+			http.Error(w, "Invalid since", http.StatusBadRequest)
+			return
+		}
+		since = v
+	}
+	// "&seqs=<conversation>:<last seq I saw>,..." replays per conversation instead
+	seqs, err := parseSyncSeqs(r.URL.Query().Get("seqs"))
+	if err != nil {
+		http.Error(w, "Invalid seqs: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	// Upgrade connection
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -111,20 +190,551 @@ func (h *Handler) ServeWs(w http.ResponseWriter, r *http.Request) {
 
 	// Create Client (Note: We added ID field to Client struct earlier)
 	client := &Client{
-		Hub:      h.hub,
-		Conn:     conn,
-		Send:     make(chan []byte, 256),
-		UserID:   userID, // 🟢 Make sure your Client struct has this!
-		Username: username,
+		Hub:       h.hub,
+		Conn:      conn,
+		Send:      make(chan []byte, 256),
+		UserID:    userID, // 🟢 Make sure your Client struct has this!
+		Username:  username,
+		ConnID:    newConnID(),
+		SyncSince: since,
+		SyncSeqs:  seqs,
 	}
 
-	// Register to Hub (This triggers the "Dual-Listen" redis subscription we wrote)
-	client.Hub.Register <- client
+	// Register to Hub (This triggers the broker subscription for this user)
+	client.Hub.Register(client)
+
+	// Tell the cluster (and our contacts) we're online
+	client.Hub.markOnline(client)
 
 	// 🔴 REMOVED: The old "Send History" loop.
-	// History is now fetched via the REST API above.
+	// History is now fetched via the REST API above; missed messages are
+	// replayed by ReadPump when the client passes ?since= or ?seqs=.
 
 	// Start pumps
 	go client.WritePump()
 	go client.ReadPump()
 }
+
+// 4. CREATE GROUP: "Start a named group with these people"
+// POST /api/conversations/groups
+// Body: { "name": "Weekend Trip", "member_ids": [2, 3] }
+func (h *Handler) CreateGroup(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name      string `json:"name"`
+		MemberIDs []int  `json:"member_ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > 100 {
+		http.Error(w, "Group name must be 1-100 characters", http.StatusBadRequest)
+		return
+	}
+
+	userID, ok := r.Context().Value(myMiddleware.UserKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	conv, err := h.repo.CreateGroupConversation(r.Context(), userID, req.Name, req.MemberIDs)
+	if err != nil {
+		writeChatError(w, err)
+		return
+	}
+
+	h.hub.publishEvent(&Event{
+		ConversationID: conv.ID,
+		Type:           FrameMembership,
+		Data: MembershipEvent{
+			ConversationID: conv.ID,
+			Action:         MembershipCreated,
+			ActorID:        userID,
+			UserIDs:        conv.Participants,
+		},
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(conv)
+}
+
+// 5. INVITE: "Add these people to my group"
+// POST /api/conversations/{id}/participants
+// Body: { "user_ids": [4, 5] }
+func (h *Handler) AddParticipants(w http.ResponseWriter, r *http.Request) {
+	conversationID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid conversation id", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		UserIDs []int `json:"user_ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.UserIDs) == 0 {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	userID, ok := r.Context().Value(myMiddleware.UserKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Any member of a group may invite others
+	if _, err := h.requireGroupRole(r, conversationID, userID, RoleMember); err != nil {
+		writeChatError(w, err)
+		return
+	}
+
+	added, err := h.repo.AddParticipants(r.Context(), conversationID, req.UserIDs)
+	if err != nil {
+		writeChatError(w, err)
+		return
+	}
+
+	if len(added) > 0 {
+		if err := h.authz.participants.Invalidate(r.Context(), conversationID); err != nil {
+			writeChatError(w, err)
+			return
+		}
+		h.hub.publishEvent(&Event{
+			ConversationID: conversationID,
+			Type:           FrameMembership,
+			Data: MembershipEvent{
+				ConversationID: conversationID,
+				Action:         MembershipAdded,
+				ActorID:        userID,
+				UserIDs:        added,
+			},
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]int{
+		"added": added,
+	})
+}
+
+// 6. REMOVE: "Kick this person out of my group" (Admins only)
+// DELETE /api/conversations/{id}/participants/{userID}
+func (h *Handler) RemoveParticipant(w http.ResponseWriter, r *http.Request) {
+	conversationID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid conversation id", http.StatusBadRequest)
+		return
+	}
+	targetID, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		http.Error(w, "Invalid user id", http.StatusBadRequest)
+		return
+	}
+
+	userID, ok := r.Context().Value(myMiddleware.UserKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	action := MembershipRemoved
+	if targetID == userID {
+		// Removing yourself is just leaving
+		action = MembershipLeft
+		_, err = h.requireGroupRole(r, conversationID, userID, RoleMember)
+	} else {
+		_, err = h.requireGroupRole(r, conversationID, userID, RoleAdmin)
+	}
+	if err != nil {
+		writeChatError(w, err)
+		return
+	}
+
+	h.removeFromGroup(w, r, conversationID, userID, targetID, action)
+}
+
+// 7. LEAVE: "Take me out of this group"
+// POST /api/conversations/{id}/leave
+func (h *Handler) LeaveConversation(w http.ResponseWriter, r *http.Request) {
+	conversationID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid conversation id", http.StatusBadRequest)
+		return
+	}
+
+	userID, ok := r.Context().Value(myMiddleware.UserKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if _, err := h.requireGroupRole(r, conversationID, userID, RoleMember); err != nil {
+		writeChatError(w, err)
+		return
+	}
+
+	h.removeFromGroup(w, r, conversationID, userID, userID, MembershipLeft)
+}
+
+// 8. INBOX: "Show me all my chats"
+// GET /api/conversations
+func (h *Handler) ListConversations(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(myMiddleware.UserKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	conversations, err := h.repo.ListConversations(r.Context(), userID)
+	if err != nil {
+		writeChatError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(conversations)
+}
+
+// 9. MARK READ: "I've read up to message 42 in this chat"
+// POST /api/conversations/{id}/read
+// Body: { "message_id": 42 }
+func (h *Handler) MarkConversationRead(w http.ResponseWriter, r *http.Request) {
+	conversationID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid conversation id", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		MessageID int `json:"message_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.MessageID <= 0 {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	userID, ok := r.Context().Value(myMiddleware.UserKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if err := h.repo.MarkConversationRead(r.Context(), conversationID, userID, req.MessageID); err != nil {
+		writeChatError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// 10. EDIT: "Fix the typo in my message"
+// PATCH /api/messages/{id}
+// Body: { "content": "fixed text" }
+func (h *Handler) EditMessage(w http.ResponseWriter, r *http.Request) {
+	messageID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid message id", http.StatusBadRequest)
+		return
+	}
+
+	// Same ceiling as a WebSocket frame; the content itself is checked by hub.EditMessage
+	r.Body = http.MaxBytesReader(w, r.Body, maxMessageSize)
+	var req struct {
+		Content string `json:"content"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	userID, ok := r.Context().Value(myMiddleware.UserKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	edited, err := h.hub.EditMessage(r.Context(), userID, messageID, req.Content)
+	if err != nil {
+		writeChatError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(edited)
+}
+
+// 11. EDIT HISTORY: "What did this message say before?"
+// GET /api/messages/{id}/edits
+func (h *Handler) GetMessageEdits(w http.ResponseWriter, r *http.Request) {
+	messageID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid message id", http.StatusBadRequest)
+		return
+	}
+
+	userID, ok := r.Context().Value(myMiddleware.UserKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	conversationID, _, err := h.repo.GetMessageOwner(r.Context(), messageID)
+	if err == nil {
+		err = h.authz.RequireParticipant(r.Context(), conversationID, userID)
+	}
+	if err != nil {
+		writeChatError(w, err)
+		return
+	}
+
+	edits, err := h.repo.GetMessageEdits(r.Context(), messageID)
+	if err != nil {
+		writeChatError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(edits)
+}
+
+// 12. DELETE: "Unsend this" / "Remove it from my phone"
+// DELETE /api/messages/{id}?scope=everyone   (default scope: me)
+func (h *Handler) DeleteMessage(w http.ResponseWriter, r *http.Request) {
+	messageID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid message id", http.StatusBadRequest)
+		return
+	}
+
+	scope := r.URL.Query().Get("scope")
+	if scope == "" {
+		scope = DeleteForMe
+	}
+
+	userID, ok := r.Context().Value(myMiddleware.UserKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	ev, err := h.hub.DeleteMessage(r.Context(), userID, messageID, scope)
+	if err != nil {
+		writeChatError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ev)
+}
+
+// 13. REACT: "👍 that"
+// POST /api/messages/{id}/reactions        Body: { "emoji": "👍" }
+// DELETE /api/messages/{id}/reactions?emoji=👍
+func (h *Handler) SetReaction(w http.ResponseWriter, r *http.Request) {
+	messageID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid message id", http.StatusBadRequest)
+		return
+	}
+
+	add := r.Method == http.MethodPost
+	emoji := r.URL.Query().Get("emoji")
+	if add {
+		var req struct {
+			Emoji string `json:"emoji"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		emoji = req.Emoji
+	}
+
+	userID, ok := r.Context().Value(myMiddleware.UserKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	ev, err := h.hub.React(r.Context(), userID, messageID, emoji, add)
+	if err != nil {
+		writeChatError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ev)
+}
+
+// removeFromGroup deletes the participant row and notifies the group (and the removed user).
+func (h *Handler) removeFromGroup(w http.ResponseWriter, r *http.Request, conversationID, actorID, targetID int, action string) {
+	if err := h.repo.RemoveParticipant(r.Context(), conversationID, targetID); err != nil {
+		writeChatError(w, err)
+		return
+	}
+	// Before the event, so the removed user can't post in the meantime. If the
+	// cache can't be cleared, say so: the removal itself is already stored.
+	if err := h.authz.participants.Invalidate(r.Context(), conversationID); err != nil {
+		writeChatError(w, err)
+		return
+	}
+
+	h.hub.publishEvent(&Event{
+		ConversationID: conversationID,
+		Type:           FrameMembership,
+		Data: MembershipEvent{
+			ConversationID: conversationID,
+			Action:         action,
+			ActorID:        actorID,
+			UserIDs:        []int{targetID},
+		},
+		Extra: []int{targetID},
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// requireGroupRole checks that the conversation is a group and that the user
+// holds at least the given role in it.
+func (h *Handler) requireGroupRole(r *http.Request, conversationID, userID int, role string) (*Conversation, error) {
+	conv, err := h.repo.GetConversation(r.Context(), conversationID)
+	if err != nil {
+		return nil, err
+	}
+	if conv.Type != "group" {
+		return nil, ErrNotGroup
+	}
+
+	actual, err := h.repo.GetParticipantRole(r.Context(), conversationID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if role == RoleAdmin && actual != RoleAdmin {
+		return nil, ErrNotAdmin
+	}
+	return conv, nil
+}
+
+// writeChatError maps chat errors to HTTP status codes.
+func writeChatError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrConversationNotFound), errors.Is(err, ErrUserNotFound), errors.Is(err, ErrMessageNotFound),
+		errors.Is(err, ErrAttachmentNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ErrNotParticipant), errors.Is(err, ErrNotAdmin), errors.Is(err, ErrNotSender),
+		errors.Is(err, ErrDeleteWindowExpired):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, ErrNotGroup), errors.Is(err, ErrOwnMessage), errors.Is(err, ErrEmptyContent), errors.Is(err, ErrContentTooLong),
+		errors.Is(err, ErrInvalidDeleteScope), errors.Is(err, ErrInvalidEmoji), errors.Is(err, ErrTooManyReactions):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrMessageDeleted):
+		http.Error(w, err.Error(), http.StatusGone)
+	case errors.Is(err, ErrAttachmentTooLarge):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	default:
+		log.Printf("❌ Chat error: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+// 14. THREAD: "Show me every reply under this message"
+// GET /api/messages/{id}/thread?before=<id>&limit=50
+func (h *Handler) GetThread(w http.ResponseWriter, r *http.Request) {
+	rootID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid message id", http.StatusBadRequest)
+		return
+	}
+
+	page, err := parseMessagePage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	userID, ok := r.Context().Value(myMiddleware.UserKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// 🔒 Replies live in the root's conversation, so that's the membership to check
+	conversationID, _, err := h.repo.GetMessageOwner(r.Context(), rootID)
+	if err == nil {
+		err = h.authz.RequireParticipant(r.Context(), conversationID, userID)
+	}
+	if err != nil {
+		writeChatError(w, err)
+		return
+	}
+
+	thread, err := h.repo.GetThread(r.Context(), rootID, userID, page)
+	if err != nil {
+		log.Printf("❌ Failed to load thread %d: %v", rootID, err)
+		http.Error(w, "Failed to load thread", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(thread)
+}
+
+// 15. SEARCH: "Where did someone mention the hotel?"
+// GET /api/messages/search?q=hotel&conversation_id=7&before=<id>&limit=50
+func (h *Handler) SearchMessages(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(myMiddleware.UserKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// A. Parse the query
+	params := r.URL.Query()
+	query := SearchQuery{Text: strings.TrimSpace(params.Get("q")), Limit: DefaultPageSize}
+	if query.Text == "" {
+		http.Error(w, "q is required", http.StatusBadRequest)
+		return
+	}
+	if len(query.Text) > maxSearchLength {
+		http.Error(w, fmt.Sprintf("q is longer than %d bytes", maxSearchLength), http.StatusBadRequest)
+		return
+	}
+	for name, dst := range map[string]*int{"conversation_id": &query.ConversationID, "before": &query.Before, "limit": &query.Limit} {
+		raw := params.Get(name)
+		if raw == "" {
+			continue
+		}
+		v, err := strconv.Atoi(raw)
+		if err != nil || v < 0 {
+			http.Error(w, "Invalid "+name, http.StatusBadRequest)
+			return
+		}
+		*dst = v
+	}
+	if query.Limit < 1 || query.Limit > MaxPageSize {
+		http.Error(w, fmt.Sprintf("limit must be between 1 and %d", MaxPageSize), http.StatusBadRequest)
+		return
+	}
+
+	// B. Narrowing to one conversation still needs membership there
+	if query.ConversationID != 0 {
+		if err := h.authz.RequireParticipant(r.Context(), query.ConversationID, userID); err != nil {
+			writeChatError(w, err)
+			return
+		}
+	}
+
+	// C. The repo only ever looks inside the caller's own conversations
+	results, err := h.repo.SearchMessages(r.Context(), userID, query)
+	if err != nil {
+		log.Printf("❌ Search failed for user %d: %v", userID, err)
+		http.Error(w, "Search failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
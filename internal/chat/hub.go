@@ -2,119 +2,379 @@ package chat
 
 import (
 	"context"
-	"encoding/json"
-	"fmt"
 	"log"
+	"sync"
+	"time"
 
-	"github.com/redis/go-redis/v9"
+	"go-chat/internal/broker"
+	"go-chat/internal/presence"
 )
 
+const (
+	// A typing indicator is cleared if the client doesn't refresh it in time
+	typingTimeout       = 8 * time.Second
+	typingSweepInterval = time.Second
+	// Frames from the broker a shard may fall behind by. When it's full,
+	// SubscribeToBroker drops the frame and the shard disconnects that user
+	// (who catches up on messages on reconnect) instead of stalling every other shard.
+	shardBroadcastBuffer = 1024
+	// Typing indicators waiting for Run. Dropped when it's full.
+	typingEventsBuffer = 1024
+)
+
+// Hub routes frames between this node's WebSocket connections and the broker.
+//
+// Connections are split over shards by user ID. Each shard owns its clients
+// and runs its own loop, so routing isn't capped at one core. All devices of
+// a user land on the same shard, which keeps the per-user broker
+// subscription and the order of that user's frames exactly as before.
 type Hub struct {
+	// Typing indicators from the shards. Everything else is fanned out by
+	// publishEvent on the goroutine that caused it.
+	typingEvents chan *Event
+
+	// How long after sending a message its sender may still delete it for
+	// everyone (0 = no limit). Set before Run() starts.
+	DeleteWindow time.Duration
+
+	shards   []*shard
+	broker   broker.Broker
+	persist  *persister // Set by StartPersistence
+	repo     *Repository
+	authz    *Authorizer
+	presence *presence.Registry
+}
+
+// shard is one slice of the node's connections. Its maps are only touched by its run().
+type shard struct {
+	hub         *Hub
 	clients     map[*Client]bool
-	userClients map[int]*Client
+	userClients map[int]map[*Client]bool // One user can be connected from many devices
 	broadcast   chan *BroadcastMessage
-	Register    chan *Client
-	Unregister  chan *Client
-	Publish     chan *Message
+	register    chan *Client
+	unregister  chan *Client
+	acks        chan *clientFrame // Replies to senders from the persist workers
+	typingIn    chan *typingUpdate
+	syncDone    chan *syncDone
 
-	redis  *redis.Client
-	pubsub *redis.PubSub
-	repo   *Repository
+	// Who is typing where, and when that indicator expires
+	typing map[*Client]map[int]time.Time
+
+	// Users whose frames SubscribeToBroker had to drop; run() disconnects them
+	lagMu   sync.Mutex
+	lagging map[int]bool
+	lagWake chan struct{}
 }
 
-func NewHub(redisClient *redis.Client, repo *Repository) *Hub {
-	return &Hub{
-		broadcast:   make(chan *BroadcastMessage),
-		Register:    make(chan *Client),
-		Unregister:  make(chan *Client),
-		clients:     make(map[*Client]bool),
-		userClients: make(map[int]*Client),
-		Publish:     make(chan *Message),
-		redis:       redisClient,
-		repo:        repo,
+func NewHub(b broker.Broker, repo *Repository, authz *Authorizer, presenceRegistry *presence.Registry, shards int) *Hub {
+	h := &Hub{
+		typingEvents: make(chan *Event, typingEventsBuffer),
+		shards:       make([]*shard, max(shards, 1)),
+		broker:       b,
+		repo:         repo,
+		authz:        authz,
+		presence:     presenceRegistry,
+	}
+	for i := range h.shards {
+		h.shards[i] = &shard{
+			hub:         h,
+			clients:     make(map[*Client]bool),
+			userClients: make(map[int]map[*Client]bool),
+			broadcast:   make(chan *BroadcastMessage, shardBroadcastBuffer),
+			register:    make(chan *Client),
+			unregister:  make(chan *Client),
+			acks:        make(chan *clientFrame),
+			typingIn:    make(chan *typingUpdate),
+			syncDone:    make(chan *syncDone),
+			typing:      make(map[*Client]map[int]time.Time),
+			lagging:     make(map[int]bool),
+			lagWake:     make(chan struct{}, 1),
+		}
 	}
+	return h
+}
+
+// shardFor picks the shard that owns a user's connections.
+func (h *Hub) shardFor(userID int) *shard {
+	return h.shards[userID%len(h.shards)]
 }
 
+// Register adds a connection. Its user's frames start flowing to it.
+func (h *Hub) Register(c *Client) {
+	h.shardFor(c.UserID).register <- c
+}
+
+// Unregister removes a connection and closes its Send channel.
+func (h *Hub) Unregister(c *Client) {
+	h.shardFor(c.UserID).unregister <- c
+}
+
+// ack hands a frame for one connection (ack or error) to the shard that owns it.
+func (h *Hub) ack(f *clientFrame) {
+	if f.client == nil {
+		return // Not a WS message
+	}
+	h.shardFor(f.client.UserID).acks <- f
+}
+
+// Run starts the shards and fans out their typing indicators. A shard can't
+// do that itself: the roster lookup may hit the database and stall its loop.
 func (h *Hub) Run() {
+	for _, s := range h.shards {
+		go s.run()
+	}
+	for ev := range h.typingEvents {
+		h.publishEvent(ev)
+	}
+}
+
+func (s *shard) run() {
+	typingSweep := time.NewTicker(typingSweepInterval)
+	defer typingSweep.Stop()
+
 	for {
 		select {
-		case client := <-h.Register:
-			h.clients[client] = true
-			h.userClients[client.UserID] = client
-			// 🟢 Listen to "user:MY_ID"
-			if h.pubsub != nil {
-				h.pubsub.Subscribe(context.Background(), fmt.Sprintf("user:%d", client.UserID))
+		case client := <-s.register:
+			s.clients[client] = true
+			client.syncing = client.needsCatchUp()
+			if s.userClients[client.UserID] == nil {
+				s.userClients[client.UserID] = make(map[*Client]bool)
+			}
+			s.userClients[client.UserID][client] = true
+			// 🟢 Listen to "user:MY_ID" (only once per user, however many devices they connect)
+			if len(s.userClients[client.UserID]) == 1 {
+				s.hub.subscribeUser(client.UserID)
 			}
 
-		case client := <-h.Unregister:
-			if _, ok := h.clients[client]; ok {
-				if h.pubsub != nil {
-					h.pubsub.Unsubscribe(context.Background(), fmt.Sprintf("user:%d", client.UserID))
+		case client := <-s.unregister:
+			if _, ok := s.clients[client]; ok {
+				// Disconnected mid-typing? Clear the indicator for everyone else.
+				for conversationID := range s.typing[client] {
+					s.setTyping(client, conversationID, false)
 				}
-				delete(h.clients, client)
-				delete(h.userClients, client.UserID)
+
+				delete(s.clients, client)
+				delete(s.userClients[client.UserID], client)
 				close(client.Send)
+
+				// Last connection of this user on this node? Stop listening.
+				if len(s.userClients[client.UserID]) == 0 {
+					delete(s.userClients, client.UserID)
+					s.hub.unsubscribeUser(client.UserID)
+				}
 			}
 
-		case msg := <-h.Publish:
-			// 1. Save to DB (The Source of Truth)
-			err := h.repo.SaveMessage(context.Background(), msg.ConversationID, msg.UserID, msg.Content)
-			if err != nil {
-				log.Printf("❌ DB Error: %v\n", err)
-				continue
+		case f := <-s.acks:
+			s.sendToClient(f.client, f.payload)
+
+		case done := <-s.syncDone:
+			if s.clients[done.client] {
+				s.flushPending(done.client, done.sentIDs)
 			}
 
-			// 2. 🟢 THE CORRECT WAY: Ask the DB "Who is in this room?"
-			participantIDs, err := h.repo.GetConversationParticipants(context.Background(), msg.ConversationID)
-			if err != nil {
-				log.Printf("❌ Failed to fetch participants: %v", err)
-				continue
+		case update := <-s.typingIn:
+			if s.clients[update.client] {
+				s.setTyping(update.client, update.conversationID, update.typing)
+			}
+
+		case <-s.lagWake:
+			s.disconnectLagging()
+
+		case now := <-typingSweep.C:
+			// Clients that went quiet without sending "stopped"
+			for client, convs := range s.typing {
+				for conversationID, expiresAt := range convs {
+					if now.After(expiresAt) {
+						s.setTyping(client, conversationID, false)
+					}
+				}
 			}
 
-			// 3. Prepare Payload
-			jsonMsg, _ := json.Marshal(map[string]interface{}{
-				"conversation_id": msg.ConversationID,
-				"username":        msg.Username,
-				"content":         msg.Content,
-				"sender_id":       msg.UserID,
-			})
-
-			// 4. 🟢 FAN-OUT: Send to every participant found in the DB
-			for _, targetID := range participantIDs {
-				// Optional: Skip sending to self if you want
-				// if targetID == msg.UserID { continue }
-
-				targetChannel := fmt.Sprintf("user:%d", targetID)
-				h.redis.Publish(context.Background(), targetChannel, jsonMsg)
+		case message := <-s.broadcast:
+			// A frame for this user was dropped: close them before anything newer
+			// reaches them, or the client would resume past the gap
+			if s.isLagging(message.TargetID) {
+				s.disconnectLagging()
+				continue
 			}
 
-		case message := <-h.broadcast:
-			// Deliver to the specific connected client
-			if client, ok := h.userClients[message.TargetID]; ok {
+			// Deliver to every device this user has connected to this node
+			for client := range s.userClients[message.TargetID] {
+				if client.syncing {
+					// Still catching up: hold live frames back so nothing arrives out of order
+					if len(client.pending) >= maxPendingFrames {
+						client.Conn.Close()
+						continue
+					}
+					client.pending = append(client.pending, message.Payload)
+					continue
+				}
 				select {
 				case client.Send <- message.Payload:
 				default:
-					close(client.Send)
-					delete(h.clients, client)
-					delete(h.userClients, message.TargetID)
+					// Too slow to keep up: drop the connection. ReadPump will fail
+					// and Unregister it, which is the only place Send gets closed.
+					client.Conn.Close()
 				}
 			}
 		}
 	}
 }
 
-func (h *Hub) SubscribeToRedis() {
-	// Start with NO subscriptions. We add them dynamically in Run().
-	h.pubsub = h.redis.Subscribe(context.Background())
-	ch := h.pubsub.Channel()
+// publishToUser sends a frame to every device of a user, on whichever node
+// they are connected, via the broker.
+func (h *Hub) publishToUser(ctx context.Context, userID int, payload []byte) {
+	if err := h.broker.Publish(ctx, userID, payload); err != nil {
+		log.Printf("❌ Failed to publish to user %d: %v", userID, err)
+	}
+}
 
-	for msg := range ch {
-		var targetID int
-		if n, _ := fmt.Sscanf(msg.Channel, "user:%d", &targetID); n == 1 {
-			h.broadcast <- &BroadcastMessage{
-				TargetID: targetID,
-				Payload:  []byte(msg.Payload),
-			}
+// subscribeUser starts receiving a user's frames on this node.
+func (h *Hub) subscribeUser(userID int) {
+	if err := h.broker.Subscribe(context.Background(), userID); err != nil {
+		log.Printf("❌ Failed to subscribe to user %d: %v", userID, err)
+	}
+}
+
+func (h *Hub) unsubscribeUser(userID int) {
+	if err := h.broker.Unsubscribe(context.Background(), userID); err != nil {
+		log.Printf("❌ Failed to unsubscribe from user %d: %v", userID, err)
+	}
+}
+
+// publishEvent fans an Event out to the conversation's participants (minus
+// the excluded user) and any extra recipients, each exactly once. It runs on
+// the caller's goroutine, so a slow roster lookup only holds up its own request.
+func (h *Hub) publishEvent(ev *Event) {
+	// Read the roster at send time, so membership changes apply right away
+	participantIDs, err := h.authz.participants.Get(context.Background(), ev.ConversationID)
+	if err != nil {
+		log.Printf("❌ Failed to fetch participants: %v", err)
+		return
+	}
+
+	jsonEvent := newFrame(ev.Type, "", ev.Data)
+
+	notified := map[int]bool{ev.ExcludeUserID: true}
+	for _, targetID := range append(participantIDs, ev.Extra...) {
+		if notified[targetID] {
+			continue
+		}
+		notified[targetID] = true
+		h.publishToUser(context.Background(), targetID, jsonEvent)
+	}
+}
+
+// setTyping tracks one client's typing state in a conversation and tells the
+// other participants when it flips. Never touches the messages table.
+func (s *shard) setTyping(client *Client, conversationID int, typing bool) {
+	convs := s.typing[client]
+	_, wasTyping := convs[conversationID]
+
+	if typing {
+		if convs == nil {
+			convs = make(map[int]time.Time)
+			s.typing[client] = convs
+		}
+		convs[conversationID] = time.Now().Add(typingTimeout)
+		if wasTyping {
+			return // Just a keep-alive, nothing changed for the others
+		}
+	} else {
+		if !wasTyping {
+			return
+		}
+		delete(convs, conversationID)
+		if len(convs) == 0 {
+			delete(s.typing, client)
+		}
+	}
+
+	state := TypingStopped
+	if typing {
+		state = TypingStarted
+	}
+	ev := &Event{
+		ConversationID: conversationID,
+		Type:           FrameTyping,
+		Data: TypingEvent{
+			ConversationID: conversationID,
+			UserID:         client.UserID,
+			Username:       client.Username,
+			State:          state,
+		},
+		ExcludeUserID: client.UserID,
+	}
+
+	// Run fans it out, never this loop: the roster lookup may hit the database.
+	// A typing indicator isn't worth waiting for, so drop it if Run is behind.
+	select {
+	case s.hub.typingEvents <- ev:
+	default:
+	}
+}
+
+// sendToClient delivers a frame straight to one connection on this node
+// (acks and errors). Must only be called from the shard's run(), which owns client.Send.
+func (s *shard) sendToClient(client *Client, payload []byte) {
+	if client == nil || !s.clients[client] {
+		return // Not a WS message, or the sender already disconnected
+	}
+	select {
+	case client.Send <- payload:
+	default:
+		client.Conn.Close()
+	}
+}
+
+// SubscribeToBroker feeds frames from other nodes (and this one) to local
+// clients. It never waits on a shard: one that is too far behind loses the
+// frame and drops that user's connections, so the others keep going.
+func (h *Hub) SubscribeToBroker() {
+	for d := range h.broker.Deliveries() {
+		s := h.shardFor(d.UserID)
+		select {
+		case s.broadcast <- &BroadcastMessage{TargetID: d.UserID, Payload: d.Payload}:
+		default:
+			s.markLagging(d.UserID)
+		}
+	}
+}
+
+// markLagging records that a frame for userID was dropped and wakes run().
+// Safe to call from any goroutine.
+func (s *shard) markLagging(userID int) {
+	s.lagMu.Lock()
+	s.lagging[userID] = true
+	s.lagMu.Unlock()
+
+	select {
+	case s.lagWake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *shard) isLagging(userID int) bool {
+	s.lagMu.Lock()
+	defer s.lagMu.Unlock()
+	return s.lagging[userID]
+}
+
+// disconnectLagging closes the connections of users who missed frames. Like
+// any slow client they reconnect with ?seqs= and catch up on messages; other
+// dropped frames (edit, delete, reaction, receipt, typing, presence) are not
+// replayed, the client sees those changes when it reloads history.
+// Must only be called from the shard's run().
+func (s *shard) disconnectLagging() {
+	s.lagMu.Lock()
+	lagging := s.lagging
+	s.lagging = make(map[int]bool)
+	s.lagMu.Unlock()
+
+	for userID := range lagging {
+		log.Printf("⚠️ Hub shard behind: disconnecting user %d so they resync", userID)
+		for client := range s.userClients[userID] {
+			client.Conn.Close()
 		}
 	}
 }
@@ -1,39 +1,379 @@
 package chat
 
-import "time"
+import (
+	"errors"
+	"fmt"
+	"time"
+)
 
 // ---------------------------------------------
 // 🗄️ Database & API Models
 // ---------------------------------------------
 
 type Conversation struct {
-	ID        int       `json:"id"`
-	Type      string    `json:"type"` // 'private' or 'group'
-	CreatedAt time.Time `json:"created_at"`
+	ID           int       `json:"id"`
+	Type         string    `json:"type"`                 // 'private' or 'group'
+	Name         string    `json:"name,omitempty"`       // Only set for groups
+	CreatedBy    int       `json:"created_by,omitempty"` // Only set for groups
+	CreatedAt    time.Time `json:"created_at"`
+	Participants []int     `json:"participants,omitempty"`
 }
 
 type Message struct {
+	ID             int               `json:"id"`
+	ConversationID int               `json:"conversation_id"`
+	Seq            int64             `json:"seq"`                     // Gapless, per-conversation order (1, 2, 3, ...)
+	ClientMsgID    string            `json:"client_msg_id,omitempty"` // Sender-generated idempotency key
+	UserID         int               `json:"user_id"`
+	Username       string            `json:"username"` // 🟢 Denormalized for UI speed (Fetched via JOIN)
+	Content        string            `json:"content"`
+	CreatedAt      time.Time         `json:"created_at"`
+	EditedAt       *time.Time        `json:"edited_at,omitempty"`   // Set once the message has been edited
+	DeletedAt      *time.Time        `json:"deleted_at,omitempty"`  // Tombstone: deleted for everyone, content is empty
+	Receipts       []Receipt         `json:"receipts,omitempty"`    // Delivery/read state per recipient (history only)
+	Reactions      []ReactionSummary `json:"reactions,omitempty"`   // Per emoji, for the viewer (history only)
+	ReplyToID      *int              `json:"reply_to_id,omitempty"` // Parent message, when this is a reply
+	ReplyTo        *ReplyPreview     `json:"reply_to,omitempty"`    // Quoted parent, for rendering the reply
+	Attachments    []*Attachment     `json:"attachments,omitempty"`
+
+	// Uploads to link to this message when it is saved (see SaveMessage)
+	attachmentIDs []int
+
+	// Set only for messages coming in over a WebSocket, so the Hub can ack the sender
+	sender *Client
+	ref    string
+}
+
+// Attachment is an uploaded file. It belongs to a conversation from upload
+// and to a message once one is sent with its ID; the bytes live in the BlobStore.
+type Attachment struct {
 	ID             int       `json:"id"`
 	ConversationID int       `json:"conversation_id"`
-	UserID         int       `json:"user_id"`
-	Username       string    `json:"username"` // 🟢 Denormalized for UI speed (Fetched via JOIN)
-	Content        string    `json:"content"`
+	MessageID      *int      `json:"message_id,omitempty"` // Nil until sent
+	UploaderID     int       `json:"uploader_id"`
+	Filename       string    `json:"filename"`
+	MimeType       string    `json:"mime_type"` // Sniffed from the content, not trusted from the client
+	Size           int64     `json:"size"`
+	SHA256         string    `json:"sha256"` // Hex
+	URL            string    `json:"url"`    // Authorized download: GET /api/attachments/{id}
 	CreatedAt      time.Time `json:"created_at"`
+
+	// Images only, filled in by the Thumbnailer after upload
+	Width           int         `json:"width,omitempty"`
+	Height          int         `json:"height,omitempty"`
+	Blurhash        string      `json:"blurhash,omitempty"`         // Placeholder to paint before any image loads
+	ThumbnailStatus string      `json:"thumbnail_status,omitempty"` // pending, ready or failed
+	Thumbnails      []Thumbnail `json:"thumbnails,omitempty"`
+
+	storageKey string
+}
+
+// Thumbnail is a downscaled JPEG copy of an image attachment.
+type Thumbnail struct {
+	Size   int    `json:"size"` // Longest edge it was fitted into (one of thumbnailSizes)
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	URL    string `json:"url"` // GET /api/attachments/{id}/thumbnails/{size}
+
+	bytes      int64
+	storageKey string
+}
+
+// Thumbnail states
+const (
+	ThumbnailPending = "pending"
+	ThumbnailReady   = "ready"
+	ThumbnailFailed  = "failed"
+)
+
+// thumbnailSizes are the longest edges we render: chat list, then inline in a conversation
+var thumbnailSizes = []int{96, 480}
+
+// Upload limits
+const (
+	MaxAttachmentSize        = 25 << 20
+	maxAttachmentsPerMessage = 10
+	maxFilenameLength        = 255
+)
+
+// ReplyPreview is the short quote of a parent message shown above a reply.
+type ReplyPreview struct {
+	ID       int    `json:"id"`
+	UserID   int    `json:"user_id"`
+	Username string `json:"username"`
+	Content  string `json:"content"`           // Truncated to previewLength
+	Deleted  bool   `json:"deleted,omitempty"` // Parent was deleted for everyone
+}
+
+// Receipt statuses a client can acknowledge
+const (
+	ReceiptDelivered = "delivered"
+	ReceiptRead      = "read"
+)
+
+// Receipt is one recipient's delivery/read state for one message.
+type Receipt struct {
+	MessageID      int        `json:"message_id"`
+	ConversationID int        `json:"conversation_id,omitempty"`
+	UserID         int        `json:"user_id"`
+	DeliveredAt    *time.Time `json:"delivered_at,omitempty"`
+	ReadAt         *time.Time `json:"read_at,omitempty"`
+}
+
+// Deletion scopes
+const (
+	DeleteForMe       = "me"
+	DeleteForEveryone = "everyone"
+)
+
+// DeleteEvent tells clients to drop a message (scope "me": only the deleting
+// user's devices get it) or to show it as a tombstone (scope "everyone").
+type DeleteEvent struct {
+	MessageID      int        `json:"message_id"`
+	ConversationID int        `json:"conversation_id"`
+	Scope          string     `json:"scope"`
+	DeletedAt      *time.Time `json:"deleted_at,omitempty"`
+}
+
+// ReactionSummary aggregates one emoji on one message. Me says whether the
+// user asking for history is among those who reacted.
+type ReactionSummary struct {
+	Emoji string `json:"emoji"`
+	Count int    `json:"count"`
+	Me    bool   `json:"me"`
+}
+
+// Reaction actions
+const (
+	ReactionAdd    = "add"
+	ReactionRemove = "remove"
+)
+
+// ReactionEvent is fanned out whenever someone adds or removes a reaction.
+// Count is the new total for that emoji on that message.
+type ReactionEvent struct {
+	MessageID      int    `json:"message_id"`
+	ConversationID int    `json:"conversation_id"`
+	UserID         int    `json:"user_id"`
+	Emoji          string `json:"emoji"`
+	Action         string `json:"action"`
+	Count          int    `json:"count"`
+}
+
+// MessageEdit is one earlier version of an edited message.
+type MessageEdit struct {
+	MessageID int       `json:"message_id"`
+	Content   string    `json:"content"`   // The content before this edit
+	EditedAt  time.Time `json:"edited_at"` // When it was replaced
+}
+
+// Typing states
+const (
+	TypingStarted = "started"
+	TypingStopped = "stopped"
+)
+
+// TypingEvent is ephemeral: it is fanned out but never stored.
+type TypingEvent struct {
+	ConversationID int    `json:"conversation_id"`
+	UserID         int    `json:"user_id"`
+	Username       string `json:"username"`
+	State          string `json:"state"`
+}
+
+// History paging bounds for /api/messages
+const (
+	DefaultPageSize = 50
+	MaxPageSize     = 100
+)
+
+// MessagePage selects one page of a conversation's history by message ID
+// and/or sequence number (e.g. to fill a gap: AfterSeq=10, BeforeSeq=15).
+type MessagePage struct {
+	Before    int   // Only messages with ID < Before (0 = start from the newest)
+	After     int   // Only messages with ID > After
+	BeforeSeq int64 // Only messages with seq < BeforeSeq (0 = no bound)
+	AfterSeq  int64 // Only messages with seq > AfterSeq
+	Limit     int
+}
+
+// MessageHistory is one page of history, newest message first.
+// NextCursor continues in the same direction the page was requested in:
+// pass it as ?before= (default) or ?after= (when paging forward). 0 = no more.
+type MessageHistory struct {
+	Messages   []*Message `json:"messages"`
+	NextCursor int        `json:"next_cursor,omitempty"`
+}
+
+// SearchQuery is a parsed GET /api/messages/search request.
+type SearchQuery struct {
+	Text           string // Web-search syntax: words, "quoted phrases", or, -excluded
+	ConversationID int    // 0 = every conversation the user is in
+	Before         int    // Message ID cursor, 0 = newest
+	Limit          int
 }
 
+// maxSearchLength caps ?q= so one request can't build a huge tsquery
+const maxSearchLength = 256
+
+// SearchResult is one matching message with where it was said.
+type SearchResult struct {
+	Message      *Message           `json:"message"`
+	Snippet      string             `json:"snippet"` // Matches wrapped in <mark></mark>; the rest is raw content, escape before rendering
+	Conversation SearchConversation `json:"conversation"`
+}
+
+type SearchConversation struct {
+	ID   int    `json:"id"`
+	Type string `json:"type"`
+	Name string `json:"name"` // Group name, or the other participant's username
+}
+
+// SearchResults is one page of matches, newest first. Pass NextCursor as ?before=.
+type SearchResults struct {
+	Results    []*SearchResult `json:"results"`
+	NextCursor int             `json:"next_cursor,omitempty"`
+}
+
+// ConversationSummary is one row of the inbox (GET /api/conversations).
+type ConversationSummary struct {
+	ID           int               `json:"id"`
+	Type         string            `json:"type"`
+	Name         string            `json:"name,omitempty"`
+	Participants []ParticipantInfo `json:"participants"`
+	LastMessage  *Message          `json:"last_message,omitempty"` // Content is a short preview
+	LastActivity time.Time         `json:"last_activity"`
+	UnreadCount  int               `json:"unread_count"`
+}
+
+type ParticipantInfo struct {
+	UserID   int    `json:"user_id"`
+	Username string `json:"username"`
+}
+
+// Participant roles inside a group conversation
+const (
+	RoleAdmin  = "admin"
+	RoleMember = "member"
+)
+
+// Membership actions carried by a MembershipEvent
+const (
+	MembershipCreated = "created"
+	MembershipAdded   = "added"
+	MembershipRemoved = "removed"
+	MembershipLeft    = "left"
+)
+
+// MembershipEvent tells clients that a group's roster changed.
+type MembershipEvent struct {
+	ConversationID int    `json:"conversation_id"`
+	Action         string `json:"action"`
+	ActorID        int    `json:"actor_id"`
+	UserIDs        []int  `json:"user_ids"`
+}
+
+// ---------------------------------------------
+// ❌ Errors (Handlers map these to HTTP status codes)
+// ---------------------------------------------
+
+var (
+	ErrConversationNotFound = errors.New("conversation not found")
+	ErrNotGroup             = errors.New("conversation is not a group")
+	ErrNotParticipant       = errors.New("user is not a participant of this conversation")
+	ErrNotAdmin             = errors.New("only group admins can do that")
+	ErrUserNotFound         = errors.New("user not found")
+	ErrMessageNotFound      = errors.New("message not found")
+	ErrOwnMessage           = errors.New("cannot acknowledge your own message")
+	ErrNotSender            = errors.New("only the sender can change this message")
+	ErrEmptyContent         = errors.New("message content is empty")
+	ErrContentTooLong       = fmt.Errorf("message content is longer than %d bytes", maxMessageSize)
+	ErrMessageDeleted       = errors.New("message was deleted")
+	ErrDeleteWindowExpired  = errors.New("too late to delete this message for everyone")
+	ErrInvalidDeleteScope   = errors.New("scope must be 'me' or 'everyone'")
+	ErrInvalidEmoji         = errors.New("reaction must be a single emoji")
+	ErrTooManyReactions     = fmt.Errorf("at most %d different reactions per message", maxReactionsPerUser)
+	ErrInvalidReply         = errors.New("can only reply to a message in the same conversation")
+	ErrAttachmentNotFound   = errors.New("attachment not found")
+	ErrInvalidAttachment    = errors.New("attachments must be your own unsent uploads to this conversation")
+	ErrAttachmentTooLarge   = fmt.Errorf("attachment is larger than %d bytes", MaxAttachmentSize)
+	ErrBusy                 = errors.New("server is busy, resend later")
+)
+
 // ---------------------------------------------
 // ⚡ Internal Hub Models
 // ---------------------------------------------
 
-// BroadcastMessage is used internally to pipe Redis messages to the Hub
+// clientFrame is a frame for one specific connection on this node (acks, errors).
+type clientFrame struct {
+	client  *Client
+	payload []byte
+}
+
+// BroadcastMessage is used internally to pipe broker messages to the Hub
 type BroadcastMessage struct {
 	TargetID int    // 0 = Everyone, >0 = Private Message
 	Payload  []byte // The actual JSON data
 }
 
-// WSMessage is the simplified JSON the frontend SENDS to us.
+// Event is a non-chat notification the Hub fans out to every current
+// participant of a conversation, plus any Extra recipients (e.g. a user who
+// was just removed and is no longer in the participants table).
+type Event struct {
+	ConversationID int
+	Type           string      // Frame type, e.g. FrameMembership
+	Data           interface{} // Marshalled as the "data" field of the payload
+	Extra          []int
+	ExcludeUserID  int // Don't notify this user (e.g. the one who is typing)
+}
+
+// typingUpdate is a client's "I started/stopped typing" on its way to the Hub.
+type typingUpdate struct {
+	client         *Client
+	conversationID int
+	typing         bool
+}
+
+// WSTyping is the "data" of a "typing" frame the frontend SENDS to us.
+type WSTyping struct {
+	ConversationID int    `json:"conversation_id"`
+	State          string `json:"state"` // TypingStarted or TypingStopped
+}
+
+// WSEdit is the "data" of an "edit" frame the frontend SENDS to us.
+type WSEdit struct {
+	MessageID int    `json:"message_id"`
+	Content   string `json:"content"`
+}
+
+// WSDelete is the "data" of a "delete" frame the frontend SENDS to us.
+type WSDelete struct {
+	MessageID int    `json:"message_id"`
+	Scope     string `json:"scope"` // DeleteForMe or DeleteForEveryone
+}
+
+// WSReaction is the "data" of a "reaction" frame the frontend SENDS to us.
+type WSReaction struct {
+	MessageID int    `json:"message_id"`
+	Emoji     string `json:"emoji"`
+	Action    string `json:"action"` // ReactionAdd or ReactionRemove
+}
+
+// WSReceipt is the "data" of a "receipt" frame the frontend SENDS to us.
+type WSReceipt struct {
+	MessageID int    `json:"message_id"`
+	Status    string `json:"status"` // ReceiptDelivered or ReceiptRead
+}
+
+// WSMessage is the "data" of a "message" frame the frontend SENDS to us.
 // They don't send ID, CreatedAt, or Username (we figure those out).
 type WSMessage struct {
 	Content        string `json:"content"`
 	ConversationID int    `json:"conversation_id"`
+	ClientMsgID    string `json:"client_msg_id,omitempty"`  // Resending with the same ID never stores twice
+	ReplyToID      int    `json:"reply_to_id,omitempty"`    // Parent message in the same conversation
+	AttachmentIDs  []int  `json:"attachment_ids,omitempty"` // Your own uploads to this conversation, not yet sent
 }
+
+// maxClientMsgIDLength matches messages.client_msg_id
+const maxClientMsgIDLength = 64
@@ -0,0 +1,269 @@
+package chat
+
+import (
+	"container/list"
+	"context"
+	"expvar"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// DefaultParticipantCacheSize is how many conversations each node keeps in memory
+	DefaultParticipantCacheSize = 10000
+	// Local copies are also dropped after this long, in case an invalidation
+	// was missed while the Redis connection was down
+	participantLocalTTL = 30 * time.Second
+	participantRedisTTL = 10 * time.Minute
+	// Bigger rosters stay local only (Lua's unpack has a stack limit)
+	participantRedisMaxMembers = 5000
+	// Membership changes are announced here so every node drops its copy
+	participantInvalidateChannel = "participants:invalidate"
+	// A failed invalidation would leave the old roster in Redis for up to
+	// participantRedisTTL, so it is retried (after 100ms, 200ms, ...)
+	participantInvalidateAttempts = 4
+	participantInvalidateBackoff  = 100 * time.Millisecond
+)
+
+// Hit/miss counters, served at /debug/vars
+var participantStats = expvar.NewMap("participant_cache")
+
+func init() {
+	participantStats.Set("hit_rate", expvar.Func(func() any {
+		local, remote := statValue("local_hits"), statValue("redis_hits")
+		total := local + remote + statValue("misses")
+		if total == 0 {
+			return 0.0
+		}
+		return float64(local+remote) / float64(total)
+	}))
+}
+
+func statValue(name string) int64 {
+	if v, ok := participantStats.Get(name).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+// ParticipantCache answers "who is in conversation X" for fan-out and
+// authorization without a query per message. Lookups go local LRU ->
+// Redis set "participants:{id}" -> Postgres, filling the layers on the way back.
+//
+// Invalidate must be called after every membership change. It bumps a
+// generation counter in Redis (so a node that read the old roster from
+// Postgres just before can't write it back) and tells every node to drop
+// its local copy.
+type ParticipantCache struct {
+	repo  *Repository
+	redis *redis.Client
+	size  int
+
+	mu      sync.Mutex
+	lru     *list.List // Front = most recently used; values are *participantEntry
+	entries map[int]*list.Element
+	// Bumped on every invalidation, so a lookup that raced one doesn't store stale data
+	epoch uint64
+}
+
+type participantEntry struct {
+	conversationID int
+	userIDs        []int
+	expiresAt      time.Time
+}
+
+func NewParticipantCache(repo *Repository, redisClient *redis.Client, size int) *ParticipantCache {
+	return &ParticipantCache{
+		repo:    repo,
+		redis:   redisClient,
+		size:    size,
+		lru:     list.New(),
+		entries: make(map[int]*list.Element),
+	}
+}
+
+func participantsKey(conversationID int) string {
+	return "participants:" + strconv.Itoa(conversationID)
+}
+
+func participantsGenKey(conversationID int) string {
+	return participantsKey(conversationID) + ":gen"
+}
+
+// Get returns the conversation's participant IDs. The slice is the caller's own.
+func (c *ParticipantCache) Get(ctx context.Context, conversationID int) ([]int, error) {
+	// 1. This node's memory
+	c.mu.Lock()
+	if el, ok := c.entries[conversationID]; ok {
+		entry := el.Value.(*participantEntry)
+		if time.Now().Before(entry.expiresAt) {
+			c.lru.MoveToFront(el)
+			ids := slices.Clone(entry.userIDs)
+			c.mu.Unlock()
+			participantStats.Add("local_hits", 1)
+			return ids, nil
+		}
+		c.removeLocked(el)
+	}
+	epoch := c.epoch
+	c.mu.Unlock()
+
+	// 2. Redis, shared by every node
+	ids, gen, err := c.getRemote(ctx, conversationID)
+	if err != nil {
+		log.Printf("⚠️ Participant cache: Redis read failed, using DB: %v", err)
+	}
+	if len(ids) > 0 {
+		participantStats.Add("redis_hits", 1)
+		c.storeLocal(conversationID, ids, epoch)
+		return slices.Clone(ids), nil
+	}
+
+	// 3. The source of truth
+	participantStats.Add("misses", 1)
+	ids, err = c.repo.GetConversationParticipants(ctx, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return ids, nil // Unknown (or empty) conversation: nothing worth caching
+	}
+	if gen != "" && len(ids) <= participantRedisMaxMembers {
+		c.storeRemote(ctx, conversationID, ids, gen)
+	}
+	c.storeLocal(conversationID, ids, epoch)
+	return slices.Clone(ids), nil
+}
+
+// getRemote reads the cached set plus the generation it must be written back under.
+func (c *ParticipantCache) getRemote(ctx context.Context, conversationID int) ([]int, string, error) {
+	pipe := c.redis.Pipeline()
+	membersCmd := pipe.SMembers(ctx, participantsKey(conversationID))
+	genCmd := pipe.Get(ctx, participantsGenKey(conversationID))
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, "", err
+	}
+
+	gen, err := genCmd.Result()
+	if err == redis.Nil {
+		gen = "0"
+	}
+
+	members := membersCmd.Val()
+	ids := make([]int, 0, len(members))
+	for _, m := range members {
+		if id, err := strconv.Atoi(m); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	return ids, gen, nil
+}
+
+// fillScript replaces the cached set, unless an invalidation bumped the
+// generation since the caller read it.
+// KEYS[1] = set, KEYS[2] = generation; ARGV = expected generation, ttl ms, members...
+var fillScript = redis.NewScript(`
+local gen = redis.call('GET', KEYS[2]) or '0'
+if gen ~= ARGV[1] then return 0 end
+redis.call('DEL', KEYS[1])
+redis.call('SADD', KEYS[1], unpack(ARGV, 3))
+redis.call('PEXPIRE', KEYS[1], ARGV[2])
+return 1
+`)
+
+func (c *ParticipantCache) storeRemote(ctx context.Context, conversationID int, ids []int, gen string) {
+	args := make([]interface{}, 0, len(ids)+2)
+	args = append(args, gen, participantRedisTTL.Milliseconds())
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	keys := []string{participantsKey(conversationID), participantsGenKey(conversationID)}
+	if err := fillScript.Run(ctx, c.redis, keys, args...).Err(); err != nil {
+		log.Printf("⚠️ Participant cache: Redis write failed: %v", err)
+	}
+}
+
+// storeLocal caches ids unless an invalidation happened since epoch was read.
+func (c *ParticipantCache) storeLocal(conversationID int, ids []int, epoch uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.epoch != epoch {
+		return
+	}
+
+	entry := &participantEntry{conversationID: conversationID, userIDs: slices.Clone(ids), expiresAt: time.Now().Add(participantLocalTTL)}
+	if el, ok := c.entries[conversationID]; ok {
+		el.Value = entry
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[conversationID] = c.lru.PushFront(entry)
+	if c.lru.Len() > c.size {
+		c.removeLocked(c.lru.Back())
+	}
+}
+
+func (c *ParticipantCache) removeLocked(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*participantEntry).conversationID)
+}
+
+// dropLocal forgets this node's copy of a roster.
+func (c *ParticipantCache) dropLocal(conversationID int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.epoch++
+	if el, ok := c.entries[conversationID]; ok {
+		c.removeLocked(el)
+	}
+}
+
+// Invalidate drops a conversation's roster everywhere: here, in Redis, and
+// (through participantInvalidateChannel) on every other node. It retries a
+// few times; an error means other nodes may still see the old roster, so the
+// caller should fail the membership request rather than carry on.
+func (c *ParticipantCache) Invalidate(ctx context.Context, conversationID int) error {
+	participantStats.Add("invalidations", 1)
+	c.dropLocal(conversationID)
+
+	genKey := participantsGenKey(conversationID)
+	for attempt := 1; ; attempt++ {
+		_, err := c.redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Incr(ctx, genKey)
+			pipe.PExpire(ctx, genKey, 2*participantRedisTTL)
+			pipe.Del(ctx, participantsKey(conversationID))
+			pipe.Publish(ctx, participantInvalidateChannel, conversationID)
+			return nil
+		})
+		if err == nil {
+			return nil
+		}
+		log.Printf("❌ Participant cache: failed to invalidate conversation %d (attempt %d): %v", conversationID, attempt, err)
+		if attempt == participantInvalidateAttempts {
+			return fmt.Errorf("invalidate participants of conversation %d: %w", conversationID, err)
+		}
+
+		select {
+		case <-time.After(time.Duration(attempt) * participantInvalidateBackoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// ListenForInvalidations drops local copies when any node changes a roster.
+func (c *ParticipantCache) ListenForInvalidations() {
+	sub := c.redis.Subscribe(context.Background(), participantInvalidateChannel)
+	for msg := range sub.Channel() {
+		if id, err := strconv.Atoi(msg.Payload); err == nil {
+			c.dropLocal(id)
+		}
+	}
+}
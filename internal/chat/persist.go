@@ -0,0 +1,135 @@
+package chat
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+const (
+	// DefaultPersistWorkers is how many goroutines write messages to Postgres
+	DefaultPersistWorkers = 4
+	// Messages waiting per worker before senders start to feel it
+	persistQueueSize = 256
+	// Most messages stored by one INSERT
+	persistBatchSize = 64
+	// How long a sender waits for room in a full queue before getting "busy"
+	persistSubmitTimeout = 2 * time.Second
+)
+
+// persister stores incoming messages off the Hub's shard loops, so a slow database
+// only slows down senders instead of every connection on the node.
+//
+// Each conversation always lands on the same worker (ID mod N), and every
+// worker handles its queue in order, so messages of one conversation are
+// stored, acked and fanned out in the order they were submitted.
+type persister struct {
+	hub    *Hub
+	queues []chan *Message
+}
+
+// StartPersistence starts the workers. Call once, before clients connect.
+func (h *Hub) StartPersistence(workers int) {
+	p := &persister{hub: h, queues: make([]chan *Message, workers)}
+	for i := range p.queues {
+		p.queues[i] = make(chan *Message, persistQueueSize)
+		go p.work(p.queues[i])
+	}
+	h.persist = p
+}
+
+// submit queues a message, waiting a little for room if its worker is behind.
+// ErrBusy tells the sender to back off and resend (with the same client_msg_id).
+func (p *persister) submit(msg *Message) error {
+	q := p.queues[msg.ConversationID%len(p.queues)]
+	select {
+	case q <- msg:
+		return nil
+	default:
+	}
+
+	timer := time.NewTimer(persistSubmitTimeout)
+	defer timer.Stop()
+	select {
+	case q <- msg:
+		return nil
+	case <-timer.C:
+		return ErrBusy
+	}
+}
+
+func (p *persister) work(q chan *Message) {
+	batch := make([]*Message, 0, persistBatchSize)
+	for msg := range q {
+		// Take whatever else is already waiting, but never wait for more:
+		// one message alone is stored right away, a burst goes in one INSERT
+		batch = append(batch[:0], msg)
+	drain:
+		for len(batch) < persistBatchSize {
+			select {
+			case next := <-q:
+				batch = append(batch, next)
+			default:
+				break drain
+			}
+		}
+		p.save(batch)
+	}
+}
+
+func (p *persister) save(batch []*Message) {
+	ctx := context.Background()
+	errs := make([]error, len(batch))
+
+	saved, duplicate, err := p.hub.repo.SaveMessages(ctx, batch)
+	if err != nil {
+		// Retry one by one, so a bad message (or a lost race) only fails itself
+		if len(batch) > 1 {
+			log.Printf("⚠️ Batch insert of %d messages failed, saving one by one: %v", len(batch), err)
+		}
+		saved = make([]*Message, len(batch))
+		duplicate = make([]bool, len(batch))
+		for i, msg := range batch {
+			saved[i], duplicate[i], errs[i] = p.hub.repo.SaveMessage(ctx, msg)
+		}
+	}
+
+	for i, msg := range batch {
+		p.hub.deliver(ctx, msg, saved[i], duplicate[i], errs[i])
+	}
+}
+
+// deliver acks a stored message to its sender and fans it out to the
+// conversation. Runs on a persist worker; only the ack goes through the sender's shard.
+func (h *Hub) deliver(ctx context.Context, msg, saved *Message, duplicate bool, err error) {
+	// 1. Tell the sender how it went
+	if err != nil {
+		log.Printf("❌ DB Error: %v\n", err)
+		h.ack(&clientFrame{client: msg.sender, payload: newErrorFrame(msg.ref, ErrCodeInternal, "failed to save message", msg.ConversationID)})
+		return
+	}
+	h.ack(&clientFrame{client: msg.sender, payload: newFrame(FrameAck, msg.ref, AckFrame{
+		MessageID:      saved.ID,
+		ConversationID: saved.ConversationID,
+		Seq:            saved.Seq,
+		ClientMsgID:    saved.ClientMsgID,
+		CreatedAt:      saved.CreatedAt,
+		Duplicate:      duplicate,
+	})})
+	if duplicate {
+		return // A resend: everyone already got the original
+	}
+
+	// 2. 🟢 THE CORRECT WAY: Ask "Who is in this room?" (cached, invalidated on membership changes)
+	participantIDs, err := h.authz.participants.Get(ctx, msg.ConversationID)
+	if err != nil {
+		log.Printf("❌ Failed to fetch participants: %v", err)
+		return
+	}
+
+	// 3. 🟢 FAN-OUT: same payload as the history API, so clients can dedupe by ID
+	jsonMsg := newFrame(FrameMessage, "", saved)
+	for _, targetID := range participantIDs {
+		h.publishToUser(ctx, targetID, jsonMsg)
+	}
+}
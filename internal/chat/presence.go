@@ -0,0 +1,74 @@
+package chat
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"time"
+
+	"go-chat/internal/presence"
+)
+
+// presenceTimeout bounds each Redis round trip for presence, so a slow Redis
+// can't hold up a client's ReadPump.
+const presenceTimeout = 2 * time.Second
+
+// markOnline registers this connection in the cluster-wide presence registry.
+// Called once per connection, right after it is registered with the Hub.
+func (h *Hub) markOnline(c *Client) {
+	ctx, cancel := context.WithTimeout(context.Background(), presenceTimeout)
+	defer cancel()
+
+	cameOnline, err := h.presence.Touch(ctx, c.UserID, c.ConnID)
+	if err != nil {
+		log.Printf("❌ Presence update failed for user %d: %v", c.UserID, err)
+		return
+	}
+	if cameOnline {
+		h.notifyContacts(ctx, &presence.Status{UserID: c.UserID, Online: true})
+	}
+}
+
+// heartbeat keeps this connection alive in the registry (called on every pong).
+func (h *Hub) heartbeat(c *Client) {
+	h.markOnline(c) // Also covers an entry that expired during a Redis blip
+}
+
+// markOffline drops this connection. Only the user's last connection in the
+// whole cluster turns them offline.
+func (h *Hub) markOffline(c *Client) {
+	ctx, cancel := context.WithTimeout(context.Background(), presenceTimeout)
+	defer cancel()
+
+	wentOffline, err := h.presence.Drop(ctx, c.UserID, c.ConnID)
+	if err != nil {
+		log.Printf("❌ Presence update failed for user %d: %v", c.UserID, err)
+		return
+	}
+	if wentOffline {
+		now := time.Now().UTC()
+		h.notifyContacts(ctx, &presence.Status{UserID: c.UserID, Online: false, LastSeen: &now})
+	}
+}
+
+// notifyContacts pushes a presence change to everyone who shares a conversation with the user.
+func (h *Hub) notifyContacts(ctx context.Context, status *presence.Status) {
+	contactIDs, err := h.repo.GetContacts(ctx, status.UserID)
+	if err != nil {
+		log.Printf("❌ Failed to fetch contacts: %v", err)
+		return
+	}
+
+	payload := newFrame(FramePresence, "", status)
+	for _, contactID := range contactIDs {
+		h.publishToUser(ctx, contactID, payload)
+	}
+}
+
+// newConnID identifies one WebSocket connection in the presence registry.
+func newConnID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
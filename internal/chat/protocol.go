@@ -0,0 +1,102 @@
+package chat
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// ---------------------------------------------
+// 📡 WebSocket Protocol (v1)
+// ---------------------------------------------
+//
+// Every frame, in both directions, is an Envelope:
+//
+//	{ "v": 1, "type": "message", "ref": "c-42", "data": { ... } }
+//
+// "ref" is an optional client-chosen correlation ID. The server echoes it
+// back in the matching "ack" or "error" frame.
+
+const ProtocolVersion = 1
+
+// Frame types
+const (
+	FrameMessage    = "message"
+	FrameAck        = "ack"
+	FrameError      = "error"
+	FrameTyping     = "typing"
+	FrameReceipt    = "receipt"
+	FrameMembership = "membership"
+	FramePresence   = "presence"
+	FrameSync       = "sync"
+	FrameEdit       = "edit"
+	FrameDelete     = "delete"
+	FrameReaction   = "reaction"
+	FrameAttachment = "attachment"
+)
+
+// Error codes carried by an "error" frame
+const (
+	ErrCodeBadRequest         = "bad_request"
+	ErrCodeUnsupportedVersion = "unsupported_version"
+	ErrCodeUnknownType        = "unknown_type"
+	ErrCodeForbidden          = "forbidden"
+	ErrCodeNotFound           = "not_found"
+	ErrCodeInternal           = "internal_error"
+	ErrCodeBusy               = "busy" // Back off and resend with the same client_msg_id
+)
+
+type Envelope struct {
+	V    int             `json:"v"`
+	Type string          `json:"type"`
+	Ref  string          `json:"ref,omitempty"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// ErrorFrame is the "data" of an "error" frame.
+type ErrorFrame struct {
+	Code           string `json:"code"`
+	Message        string `json:"message"`
+	ConversationID int    `json:"conversation_id,omitempty"`
+}
+
+// AckFrame is the "data" of an "ack" frame, sent only to the sender once the
+// message is persisted. Duplicate means this client_msg_id was already stored:
+// the fields describe the original and nothing was re-broadcast.
+type AckFrame struct {
+	MessageID      int       `json:"message_id"`
+	ConversationID int       `json:"conversation_id"`
+	Seq            int64     `json:"seq"`
+	ClientMsgID    string    `json:"client_msg_id,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+	Duplicate      bool      `json:"duplicate,omitempty"`
+}
+
+// SyncFrame is the "data" of the "sync" frame that ends offline catch-up.
+// After it, everything is live. Truncated means there was more than we are
+// willing to stream; page the rest through /api/messages.
+type SyncFrame struct {
+	LastMessageID int  `json:"last_message_id"`
+	Count         int  `json:"count"`
+	Truncated     bool `json:"truncated,omitempty"`
+}
+
+// newFrame builds a server -> client envelope.
+func newFrame(frameType, ref string, data interface{}) []byte {
+	raw, _ := json.Marshal(data)
+	frame, _ := json.Marshal(Envelope{
+		V:    ProtocolVersion,
+		Type: frameType,
+		Ref:  ref,
+		Data: raw,
+	})
+	return frame
+}
+
+// newErrorFrame builds an "error" frame.
+func newErrorFrame(ref, code, message string, conversationID int) []byte {
+	return newFrame(FrameError, ref, ErrorFrame{
+		Code:           code,
+		Message:        message,
+		ConversationID: conversationID,
+	})
+}
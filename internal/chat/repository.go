@@ -3,7 +3,11 @@ package chat
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
 )
 
 type Repository struct {
@@ -81,40 +85,1372 @@ func (r *Repository) CreatePrivateConversation(ctx context.Context, user1ID, use
 	return conversationID, nil
 }
 
-// SaveMessage now requires a conversationID
-func (r *Repository) SaveMessage(ctx context.Context, conversationID int, senderID int, content string) error {
-	query := `INSERT INTO messages (conversation_id, sender_id, content) VALUES ($1, $2, $3)`
-	_, err := r.db.ExecContext(ctx, query, conversationID, senderID, content)
+// CreateGroupConversation creates a named group. The creator becomes its admin,
+// everyone in memberIDs joins as a regular member.
+func (r *Repository) CreateGroupConversation(ctx context.Context, creatorID int, name string, memberIDs []int) (*Conversation, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	conv := &Conversation{Type: "group", Name: name, CreatedBy: creatorID}
+
+	// A. Create the Conversation Row
+	err = tx.QueryRowContext(ctx,
+		"INSERT INTO conversations (type, name, created_by) VALUES ('group', $1, $2) RETURNING id, created_at",
+		name, creatorID,
+	).Scan(&conv.ID, &conv.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create group: %w", err)
+	}
+
+	// B. Creator is the first admin
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO participants (conversation_id, user_id, role) VALUES ($1, $2, $3)",
+		conv.ID, creatorID, RoleAdmin,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to add creator: %w", err)
+	}
+	conv.Participants = append(conv.Participants, creatorID)
+
+	// C. Everyone else joins as a member (duplicates are ignored)
+	for _, memberID := range memberIDs {
+		if memberID == creatorID {
+			continue
+		}
+		res, err := tx.ExecContext(ctx,
+			"INSERT INTO participants (conversation_id, user_id, role) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING",
+			conv.ID, memberID, RoleMember,
+		)
+		if err != nil {
+			return nil, mapUserFKError(fmt.Errorf("failed to add member %d: %w", memberID, err))
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			conv.Participants = append(conv.Participants, memberID)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return conv, nil
+}
+
+// GetConversation loads a conversation row (without participants).
+func (r *Repository) GetConversation(ctx context.Context, conversationID int) (*Conversation, error) {
+	conv := &Conversation{}
+	var name sql.NullString
+	var createdBy sql.NullInt64
+
+	query := `SELECT id, type, name, created_by, created_at FROM conversations WHERE id = $1`
+	err := r.db.QueryRowContext(ctx, query, conversationID).Scan(&conv.ID, &conv.Type, &name, &createdBy, &conv.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrConversationNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	conv.Name = name.String
+	conv.CreatedBy = int(createdBy.Int64)
+	return conv, nil
+}
+
+// GetParticipantRole returns the role of a user inside a conversation,
+// or ErrNotParticipant if they are not in it.
+func (r *Repository) GetParticipantRole(ctx context.Context, conversationID, userID int) (string, error) {
+	var role string
+	query := `SELECT COALESCE(role, 'member') FROM participants WHERE conversation_id = $1 AND user_id = $2`
+	err := r.db.QueryRowContext(ctx, query, conversationID, userID).Scan(&role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrNotParticipant
+	}
+	return role, err
+}
+
+// AddParticipants adds users to a conversation as regular members.
+// It returns only the IDs that were actually added (existing members are skipped).
+func (r *Repository) AddParticipants(ctx context.Context, conversationID int, userIDs []int) ([]int, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var added []int
+	for _, userID := range userIDs {
+		res, err := tx.ExecContext(ctx,
+			"INSERT INTO participants (conversation_id, user_id, role) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING",
+			conversationID, userID, RoleMember,
+		)
+		if err != nil {
+			return nil, mapUserFKError(fmt.Errorf("failed to add participant %d: %w", userID, err))
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			added = append(added, userID)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return added, nil
+}
+
+// RemoveParticipant takes a user out of a conversation. If that leaves the
+// group without an admin, the longest-standing remaining member is promoted.
+func (r *Repository) RemoveParticipant(ctx context.Context, conversationID, userID int) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, "DELETE FROM participants WHERE conversation_id = $1 AND user_id = $2", conversationID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to remove participant: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotParticipant
+	}
+
+	// Never leave a group without an admin
+	_, err = tx.ExecContext(ctx, `
+        UPDATE participants SET role = 'admin'
+        WHERE conversation_id = $1
+        AND NOT EXISTS (SELECT 1 FROM participants WHERE conversation_id = $1 AND role = 'admin')
+        AND user_id = (SELECT user_id FROM participants WHERE conversation_id = $1 ORDER BY joined_at ASC, user_id ASC LIMIT 1)
+    `, conversationID)
+	if err != nil {
+		return fmt.Errorf("failed to promote new admin: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// mapUserFKError turns a foreign key violation on participants.user_id into ErrUserNotFound.
+func mapUserFKError(err error) error {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23503" {
+		return ErrUserNotFound
+	}
 	return err
 }
 
-// GetConversationMessages fetches history for a specific room
-func (r *Repository) GetConversationMessages(ctx context.Context, conversationID int) ([]*Message, error) {
+// messageColumns is the SELECT list every message query shares ("m" = messages,
+// "u" = the sender in users, "pm"/"pu" = the replied-to message and its sender
+// from replyJoins), in the order scanMessage expects.
+const messageColumns = `m.id, m.conversation_id, m.seq, COALESCE(m.client_msg_id, ''), m.content, m.created_at, m.edited_at, m.deleted_at, m.sender_id, u.username,
+        m.reply_to_id, pm.sender_id, pu.username, pm.content, pm.deleted_at IS NOT NULL`
+
+// replyJoins pulls in the parent of a reply, for the quoted preview.
+const replyJoins = `
+        LEFT JOIN messages pm ON pm.id = m.reply_to_id
+        LEFT JOIN users pu ON pu.id = pm.sender_id`
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanMessage reads one row of messageColumns; extra receives any columns selected after them.
+func scanMessage(row rowScanner, extra ...interface{}) (*Message, error) {
+	msg := &Message{}
+	var (
+		parentID, parentSenderID sql.NullInt64
+		parentSender, parentText sql.NullString
+		parentDeleted            sql.NullBool
+	)
+	dest := []interface{}{&msg.ID, &msg.ConversationID, &msg.Seq, &msg.ClientMsgID, &msg.Content, &msg.CreatedAt, &msg.EditedAt, &msg.DeletedAt, &msg.UserID, &msg.Username,
+		&parentID, &parentSenderID, &parentSender, &parentText, &parentDeleted}
+	err := row.Scan(append(dest, extra...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	if parentID.Valid {
+		id := int(parentID.Int64)
+		msg.ReplyToID = &id
+		msg.ReplyTo = &ReplyPreview{
+			ID:       id,
+			UserID:   int(parentSenderID.Int64),
+			Username: parentSender.String,
+			Content:  preview(parentText.String),
+			Deleted:  parentDeleted.Bool,
+		}
+	}
+	return msg, nil
+}
+
+// scanMessages drains rows of messageColumns.
+func scanMessages(rows *sql.Rows) ([]*Message, error) {
+	messages := []*Message{}
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+	return messages, rows.Err()
+}
+
+// SaveMessage stores msg (ConversationID, UserID, Content, optional
+// ClientMsgID) and returns the stored row in the same shape
+// GetConversationMessages uses, so live and history payloads match.
+//
+// The message gets the conversation's next sequence number. Bumping last_seq
+// row-locks the conversation until the insert commits, so concurrent senders
+// (even on different nodes) queue up and sequences stay gapless: if the
+// insert fails, the bump rolls back with it.
+//
+// If the sender already stored a message with the same ClientMsgID in this
+// conversation (a resend after a reconnect), nothing is inserted: the original comes back with
+// duplicate = true.
+func (r *Repository) SaveMessage(ctx context.Context, msg *Message) (saved *Message, duplicate bool, err error) {
+	if msg.ClientMsgID != "" {
+		if existing, err := r.getMessageByClientID(ctx, msg.UserID, msg.ConversationID, msg.ClientMsgID); err == nil {
+			return existing, true, r.attachAttachments(ctx, []*Message{existing})
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			return nil, false, err
+		}
+	}
+
 	query := `
-        SELECT m.id, m.conversation_id, m.content, m.created_at, m.sender_id, u.username
+        WITH next AS (
+            UPDATE conversations SET last_seq = last_seq + 1
+            WHERE id = $1
+            RETURNING last_seq
+        ), m AS (
+            INSERT INTO messages (conversation_id, sender_id, content, seq, client_msg_id, reply_to_id)
+            SELECT $1, $2, $3, last_seq, NULLIF($4, ''), $5 FROM next
+            RETURNING *
+        ), linked AS (
+            UPDATE attachments a SET message_id = m.id
+            FROM m
+            WHERE a.id = ANY($6) AND a.uploader_id = $2 AND a.conversation_id = $1 AND a.message_id IS NULL
+        )
+        SELECT ` + messageColumns + `
+        FROM m
+        JOIN users u ON m.sender_id = u.id` + replyJoins + `
+    `
+	saved, err = scanMessage(r.db.QueryRowContext(ctx, query, msg.ConversationID, msg.UserID, msg.Content, msg.ClientMsgID, msg.ReplyToID, msg.attachmentIDs))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, false, ErrConversationNotFound
+	}
+
+	// Lost a race against a concurrent resend of the same message
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" && pgErr.ConstraintName == "idx_messages_sender_conv_client_msg_id" {
+		saved, err = r.getMessageByClientID(ctx, msg.UserID, msg.ConversationID, msg.ClientMsgID)
+		duplicate = true
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	// The linked uploads aren't visible to the statement that linked them
+	if err := r.attachAttachments(ctx, []*Message{saved}); err != nil {
+		return nil, false, err
+	}
+	return saved, duplicate, nil
+}
+
+// SaveMessages stores a batch in as few round trips as possible: one lookup
+// for resends, then one transaction that reserves a block of seq numbers per
+// conversation and inserts every new message with a single multi-row INSERT.
+// Results line up with msgs. Messages of one conversation get their seq in
+// slice order. Any error fails the whole batch (nothing is stored).
+func (r *Repository) SaveMessages(ctx context.Context, msgs []*Message) (saved []*Message, duplicate []bool, err error) {
+	saved = make([]*Message, len(msgs))
+	duplicate = make([]bool, len(msgs))
+
+	// 1. Resends: same sender + conversation + client_msg_id as something already stored
+	if err := r.findResends(ctx, msgs, saved, duplicate); err != nil {
+		return nil, nil, err
+	}
+
+	var fresh []int // Indexes into msgs
+	for i := range msgs {
+		if saved[i] == nil {
+			fresh = append(fresh, i)
+		}
+	}
+	if len(fresh) > 0 {
+		if err := r.insertBatch(ctx, msgs, fresh, saved); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if err := r.attachAttachments(ctx, saved); err != nil {
+		return nil, nil, err
+	}
+	return saved, duplicate, nil
+}
+
+// findResends fills saved/duplicate for messages whose client_msg_id is already stored.
+func (r *Repository) findResends(ctx context.Context, msgs []*Message, saved []*Message, duplicate []bool) error {
+	var senders, convs []int
+	var clientIDs []string
+	for _, msg := range msgs {
+		if msg.ClientMsgID != "" {
+			senders = append(senders, msg.UserID)
+			convs = append(convs, msg.ConversationID)
+			clientIDs = append(clientIDs, msg.ClientMsgID)
+		}
+	}
+	if len(senders) == 0 {
+		return nil
+	}
+
+	query := `
+        SELECT ` + messageColumns + `
         FROM messages m
-        JOIN users u ON m.sender_id = u.id
+        JOIN users u ON m.sender_id = u.id` + replyJoins + `
+        WHERE (m.sender_id, m.conversation_id, m.client_msg_id) IN (SELECT * FROM unnest($1::int[], $2::int[], $3::text[]))
+    `
+	rows, err := r.db.QueryContext(ctx, query, senders, convs, clientIDs)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	existing, err := scanMessages(rows)
+	if err != nil {
+		return err
+	}
+	for _, e := range existing {
+		for i, msg := range msgs {
+			if msg.UserID == e.UserID && msg.ConversationID == e.ConversationID && msg.ClientMsgID == e.ClientMsgID {
+				saved[i], duplicate[i] = e, true
+			}
+		}
+	}
+	return nil
+}
+
+// insertBatch inserts msgs[i] for every i in fresh and stores the rows in saved.
+func (r *Repository) insertBatch(ctx context.Context, msgs []*Message, fresh []int, saved []*Message) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// A. How many seq numbers each conversation needs
+	counts := make(map[int]int)
+	for _, i := range fresh {
+		counts[msgs[i].ConversationID]++
+	}
+	convIDs := make([]int, 0, len(counts))
+	needed := make([]int, 0, len(counts))
+	for id, n := range counts {
+		convIDs = append(convIDs, id)
+		needed = append(needed, n)
+	}
+
+	// B. Lock the conversations in ID order (so two nodes can't deadlock), then reserve the blocks
+	if _, err := tx.ExecContext(ctx, "SELECT id FROM conversations WHERE id = ANY($1) ORDER BY id FOR UPDATE", convIDs); err != nil {
+		return err
+	}
+	rows, err := tx.QueryContext(ctx, `
+        UPDATE conversations c SET last_seq = c.last_seq + v.n
+        FROM unnest($1::int[], $2::int[]) AS v(id, n)
+        WHERE c.id = v.id
+        RETURNING c.id, c.last_seq
+    `, convIDs, needed)
+	if err != nil {
+		return err
+	}
+	next := make(map[int]int64) // Conversation -> first seq of its block
+	for rows.Next() {
+		var id int
+		var last int64
+		if err := rows.Scan(&id, &last); err != nil {
+			rows.Close()
+			return err
+		}
+		next[id] = last - int64(counts[id]) + 1
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(next) != len(counts) {
+		return ErrConversationNotFound
+	}
+
+	// C. One INSERT for the whole batch
+	var (
+		conv, sender, reply []int
+		content, clientID   []string
+		seq                 []int64
+		linkSeq             []int64
+		linkConv, linkAtt   []int
+	)
+	for _, i := range fresh {
+		msg := msgs[i]
+		s := next[msg.ConversationID]
+		next[msg.ConversationID]++
+
+		replyTo := 0
+		if msg.ReplyToID != nil {
+			replyTo = *msg.ReplyToID
+		}
+		conv = append(conv, msg.ConversationID)
+		sender = append(sender, msg.UserID)
+		content = append(content, msg.Content)
+		seq = append(seq, s)
+		clientID = append(clientID, msg.ClientMsgID)
+		reply = append(reply, replyTo)
+		for _, attachmentID := range msg.attachmentIDs {
+			linkConv = append(linkConv, msg.ConversationID)
+			linkSeq = append(linkSeq, s)
+			linkAtt = append(linkAtt, attachmentID)
+		}
+	}
+	_, err = tx.ExecContext(ctx, `
+        INSERT INTO messages (conversation_id, sender_id, content, seq, client_msg_id, reply_to_id)
+        SELECT conv, sender, content, seq, NULLIF(client_msg_id, ''), NULLIF(reply_to_id, 0)
+        FROM unnest($1::int[], $2::int[], $3::text[], $4::bigint[], $5::text[], $6::int[])
+            AS t(conv, sender, content, seq, client_msg_id, reply_to_id)
+    `, conv, sender, content, seq, clientID, reply)
+	if err != nil {
+		return err
+	}
+
+	// D. Hand over uploads (same rules as SaveMessage)
+	if len(linkAtt) > 0 {
+		_, err = tx.ExecContext(ctx, `
+            UPDATE attachments a SET message_id = m.id
+            FROM unnest($1::int[], $2::bigint[], $3::int[]) AS l(conv, seq, attachment_id)
+            JOIN messages m ON m.conversation_id = l.conv AND m.seq = l.seq
+            WHERE a.id = l.attachment_id AND a.uploader_id = m.sender_id
+            AND a.conversation_id = m.conversation_id AND a.message_id IS NULL
+        `, linkConv, linkSeq, linkAtt)
+		if err != nil {
+			return err
+		}
+	}
+
+	// E. Read the rows back; (conversation_id, seq) is unique, so that's our key
+	rows, err = tx.QueryContext(ctx, `
+        SELECT `+messageColumns+`
+        FROM messages m
+        JOIN users u ON m.sender_id = u.id`+replyJoins+`
+        WHERE (m.conversation_id, m.seq) IN (SELECT * FROM unnest($1::int[], $2::bigint[]))
+    `, conv, seq)
+	if err != nil {
+		return err
+	}
+	inserted, err := scanMessages(rows)
+	rows.Close()
+	if err != nil {
+		return err
+	}
+
+	type key struct {
+		conv int
+		seq  int64
+	}
+	byKey := make(map[key]*Message, len(inserted))
+	for _, m := range inserted {
+		byKey[key{m.ConversationID, m.Seq}] = m
+	}
+	for n, i := range fresh {
+		if saved[i] = byKey[key{conv[n], seq[n]}]; saved[i] == nil {
+			return fmt.Errorf("inserted message %d/%d not found", conv[n], seq[n])
+		}
+	}
+	return tx.Commit()
+}
+
+// getMessageByClientID finds a sender's message by its client-generated ID.
+func (r *Repository) getMessageByClientID(ctx context.Context, senderID, conversationID int, clientMsgID string) (*Message, error) {
+	query := `
+        SELECT ` + messageColumns + `
+        FROM messages m
+        JOIN users u ON m.sender_id = u.id` + replyJoins + `
+        WHERE m.sender_id = $1 AND m.conversation_id = $2 AND m.client_msg_id = $3
+    `
+	return scanMessage(r.db.QueryRowContext(ctx, query, senderID, conversationID, clientMsgID))
+}
+
+// GetConversationMessages fetches one page of history for a specific room,
+// newest message first, as seen by viewerID (messages they deleted for
+// themselves are left out, so their seq numbers show up as gaps).
+func (r *Repository) GetConversationMessages(ctx context.Context, conversationID, viewerID int, page MessagePage) (*MessageHistory, error) {
+	// Paging forward (only ?after=) walks up from the cursor; everything else walks down from ?before= / the newest.
+	forward := (page.After > 0 || page.AfterSeq > 0) && page.Before == 0 && page.BeforeSeq == 0
+	order := "DESC"
+	if forward {
+		order = "ASC"
+	}
+
+	// Within a conversation, ID order and seq order are the same (SaveMessage
+	// assigns both under the conversation's row lock)
+	query := `
+        SELECT ` + messageColumns + `
+        FROM messages m
+        JOIN users u ON m.sender_id = u.id` + replyJoins + `
         WHERE m.conversation_id = $1
-        ORDER BY m.created_at ASC 
-        LIMIT 50
+        AND ($2 = 0 OR m.id < $2)
+        AND m.id > $3
+        AND ($5 = 0 OR m.seq < $5)
+        AND m.seq > $6
+        AND NOT EXISTS (SELECT 1 FROM message_hidden h WHERE h.message_id = m.id AND h.user_id = $7)
+        ORDER BY m.id ` + order + `
+        LIMIT $4
     `
-	// Note: Changed ORDER BY to ASC so older messages appear at top (standard for chat history)
+	// Fetch one extra row to know whether another page exists
+	rows, err := r.db.QueryContext(ctx, query, conversationID, page.Before, page.After, page.Limit+1, page.BeforeSeq, page.AfterSeq, viewerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-	rows, err := r.db.QueryContext(ctx, query, conversationID)
+	messages, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+	return r.buildHistory(ctx, messages, viewerID, page, forward)
+}
+
+// buildHistory trims a limit+1 page into a MessageHistory (newest first) and
+// attaches receipts and the viewer's reactions.
+func (r *Repository) buildHistory(ctx context.Context, messages []*Message, viewerID int, page MessagePage, forward bool) (*MessageHistory, error) {
+	if err := r.attachReceipts(ctx, messages); err != nil {
+		return nil, err
+	}
+	if err := r.attachAttachments(ctx, messages); err != nil {
+		return nil, err
+	}
+	if err := r.attachReactions(ctx, messages, viewerID); err != nil {
+		return nil, err
+	}
+
+	history := &MessageHistory{Messages: messages}
+	if len(messages) > page.Limit {
+		history.Messages = messages[:page.Limit]
+		// The last row of the page (oldest when going back, newest when going forward)
+		history.NextCursor = history.Messages[page.Limit-1].ID
+	}
+
+	if forward {
+		// Always hand back newest first
+		for i, j := 0, len(history.Messages)-1; i < j; i, j = i+1, j-1 {
+			history.Messages[i], history.Messages[j] = history.Messages[j], history.Messages[i]
+		}
+	}
+	return history, nil
+}
+
+// GetThread pages through every reply under rootID, however deeply nested,
+// with the same cursors as GetConversationMessages. The root itself is not included.
+func (r *Repository) GetThread(ctx context.Context, rootID, viewerID int, page MessagePage) (*MessageHistory, error) {
+	forward := (page.After > 0 || page.AfterSeq > 0) && page.Before == 0 && page.BeforeSeq == 0
+	order := "DESC"
+	if forward {
+		order = "ASC"
+	}
+
+	query := `
+        WITH RECURSIVE thread AS (
+            SELECT id FROM messages WHERE reply_to_id = $1
+            UNION
+            SELECT r.id FROM messages r JOIN thread t ON r.reply_to_id = t.id
+        )
+        SELECT ` + messageColumns + `
+        FROM thread
+        JOIN messages m ON m.id = thread.id
+        JOIN users u ON m.sender_id = u.id` + replyJoins + `
+        WHERE ($2 = 0 OR m.id < $2)
+        AND m.id > $3
+        AND ($5 = 0 OR m.seq < $5)
+        AND m.seq > $6
+        AND NOT EXISTS (SELECT 1 FROM message_hidden h WHERE h.message_id = m.id AND h.user_id = $7)
+        ORDER BY m.id ` + order + `
+        LIMIT $4
+    `
+	rows, err := r.db.QueryContext(ctx, query, rootID, page.Before, page.After, page.Limit+1, page.BeforeSeq, page.AfterSeq, viewerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+	return r.buildHistory(ctx, messages, viewerID, page, forward)
+}
+
+// SearchMessages runs a full-text query over every conversation the viewer is
+// in (or just conversationID, when set), newest match first.
+func (r *Repository) SearchMessages(ctx context.Context, viewerID int, q SearchQuery) (*SearchResults, error) {
+	// Private chats have no name, so label them with the other participant
+	query := `
+        SELECT ` + messageColumns + `,
+            ts_headline('english', m.content, tsq, 'StartSel=<mark>, StopSel=</mark>, MaxFragments=2, MaxWords=20, MinWords=5'),
+            c.id, c.type,
+            COALESCE(c.name, (
+                SELECT ou.username FROM participants op
+                JOIN users ou ON ou.id = op.user_id
+                WHERE op.conversation_id = c.id AND op.user_id <> $1
+                LIMIT 1
+            ), '')
+        FROM messages m
+        JOIN participants p ON p.conversation_id = m.conversation_id AND p.user_id = $1
+        JOIN conversations c ON c.id = m.conversation_id
+        JOIN users u ON m.sender_id = u.id` + replyJoins + `
+        CROSS JOIN websearch_to_tsquery('english', $2) tsq
+        WHERE m.content_tsv @@ tsq
+        AND m.deleted_at IS NULL
+        AND ($3 = 0 OR m.conversation_id = $3)
+        AND ($4 = 0 OR m.id < $4)
+        AND NOT EXISTS (SELECT 1 FROM message_hidden h WHERE h.message_id = m.id AND h.user_id = $1)
+        ORDER BY m.id DESC
+        LIMIT $5
+    `
+	// Fetch one extra row to know whether another page exists
+	rows, err := r.db.QueryContext(ctx, query, viewerID, q.Text, q.ConversationID, q.Before, q.Limit+1)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var messages []*Message
+	results := &SearchResults{Results: []*SearchResult{}}
 	for rows.Next() {
-		msg := &Message{}
-		if err := rows.Scan(&msg.ID, &msg.ConversationID, &msg.Content, &msg.CreatedAt, &msg.UserID, &msg.Username); err != nil {
+		hit := &SearchResult{}
+		hit.Message, err = scanMessage(rows, &hit.Snippet, &hit.Conversation.ID, &hit.Conversation.Type, &hit.Conversation.Name)
+		if err != nil {
 			return nil, err
 		}
-		messages = append(messages, msg)
+		results.Results = append(results.Results, hit)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(results.Results) > q.Limit {
+		results.Results = results.Results[:q.Limit]
+		results.NextCursor = results.Results[q.Limit-1].Message.ID
+	}
+	return results, nil
+}
+
+// GetMessagesSince returns the messages a reconnecting user missed, from
+// every conversation they are currently in, oldest first. In a conversation
+// listed in seqs that's every message after that seq: seq order is commit
+// order, so a message that committed late can't hide below it. Conversations
+// not listed (e.g. new ones) fall back to messages newer than sinceID, if it
+// is set. Only messages with an ID above afterID are returned, for paging.
+func (r *Repository) GetMessagesSince(ctx context.Context, userID, sinceID int, seqs map[int]int64, afterID, limit int) ([]*Message, error) {
+	convs := make([]int, 0, len(seqs))
+	lastSeqs := make([]int64, 0, len(seqs))
+	for conv, seq := range seqs {
+		convs = append(convs, conv)
+		lastSeqs = append(lastSeqs, seq)
+	}
+
+	query := `
+        SELECT ` + messageColumns + `
+        FROM messages m
+        JOIN participants p ON p.conversation_id = m.conversation_id AND p.user_id = $1
+        JOIN users u ON m.sender_id = u.id` + replyJoins + `
+        LEFT JOIN unnest($3::int[], $4::bigint[]) AS known(conversation_id, seq) ON known.conversation_id = m.conversation_id
+        WHERE m.id > $5
+        AND (m.seq > known.seq OR (known.seq IS NULL AND $2 > 0 AND m.id > $2))
+        AND NOT EXISTS (SELECT 1 FROM message_hidden h WHERE h.message_id = m.id AND h.user_id = $1)
+        ORDER BY m.id ASC
+        LIMIT $6
+    `
+	rows, err := r.db.QueryContext(ctx, query, userID, sinceID, convs, lastSeqs, afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+	return messages, r.attachAttachments(ctx, messages)
+}
+
+// GetMessageOwner returns which conversation a message belongs to and who sent it.
+func (r *Repository) GetMessageOwner(ctx context.Context, messageID int) (conversationID, senderID int, err error) {
+	query := `SELECT conversation_id, sender_id FROM messages WHERE id = $1`
+	err = r.db.QueryRowContext(ctx, query, messageID).Scan(&conversationID, &senderID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, 0, ErrMessageNotFound
+	}
+	return conversationID, senderID, err
+}
+
+// GetMessage loads a single message by ID.
+func (r *Repository) GetMessage(ctx context.Context, messageID int) (*Message, error) {
+	query := `
+        SELECT ` + messageColumns + `
+        FROM messages m
+        JOIN users u ON m.sender_id = u.id` + replyJoins + `
+        WHERE m.id = $1
+    `
+	msg, err := scanMessage(r.db.QueryRowContext(ctx, query, messageID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrMessageNotFound
+	}
+	return msg, err
+}
+
+// EditMessage swaps in new content and archives the old version in message_edits.
+// Unchanged content is left alone (changed = false).
+func (r *Repository) EditMessage(ctx context.Context, messageID int, content string) (edited *Message, changed bool, err error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, false, err
 	}
-	return messages, nil
+	defer tx.Rollback()
+
+	// Lock the row so two concurrent edits archive in order
+	var previous string
+	var deleted bool
+	err = tx.QueryRowContext(ctx, "SELECT content, deleted_at IS NOT NULL FROM messages WHERE id = $1 FOR UPDATE", messageID).Scan(&previous, &deleted)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, false, ErrMessageNotFound
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if deleted {
+		return nil, false, ErrMessageDeleted
+	}
+
+	if previous == content {
+		msg, err := r.GetMessage(ctx, messageID)
+		return msg, false, err // Nothing to archive or announce
+	}
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO message_edits (message_id, content) VALUES ($1, $2)", messageID, previous)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to archive previous version: %w", err)
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE messages SET content = $2, edited_at = NOW() WHERE id = $1", messageID, content)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to edit message: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, false, err
+	}
+	edited, err = r.GetMessage(ctx, messageID)
+	return edited, true, err
+}
+
+// DeleteMessageForEveryone turns a message into a tombstone: content and edit
+// history are wiped, deleted_at is set. Allowed only within window of sending
+// (0 = no limit). Deleting a tombstone again is a no-op.
+func (r *Repository) DeleteMessageForEveryone(ctx context.Context, messageID int, window time.Duration) (*Message, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Compare on the DB clock, the same one that stamped created_at
+	var alreadyDeleted, inWindow bool
+	err = tx.QueryRowContext(ctx, `
+        SELECT deleted_at IS NOT NULL, ($2 = 0 OR created_at > NOW() - $2 * INTERVAL '1 millisecond')
+        FROM messages WHERE id = $1
+        FOR UPDATE
+    `, messageID, window.Milliseconds()).Scan(&alreadyDeleted, &inWindow)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrMessageNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !alreadyDeleted {
+		if !inWindow {
+			return nil, ErrDeleteWindowExpired
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE messages SET content = '', deleted_at = NOW() WHERE id = $1", messageID); err != nil {
+			return nil, fmt.Errorf("failed to delete message: %w", err)
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM message_edits WHERE message_id = $1", messageID); err != nil {
+			return nil, fmt.Errorf("failed to delete edit history: %w", err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return r.GetMessage(ctx, messageID)
+}
+
+// HideMessage removes a message from one user's view only ("delete for me").
+func (r *Repository) HideMessage(ctx context.Context, messageID, userID int) error {
+	query := `INSERT INTO message_hidden (message_id, user_id) VALUES ($1, $2) ON CONFLICT DO NOTHING`
+	_, err := r.db.ExecContext(ctx, query, messageID, userID)
+	return err
+}
+
+// SetReaction adds or removes one user's emoji on a message (both idempotent)
+// and returns the new total for that emoji. Adding a new emoji fails with
+// ErrTooManyReactions once the user has maxReactionsPerUser on the message.
+func (r *Repository) SetReaction(ctx context.Context, messageID, userID int, emoji string, add bool) (int, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if add {
+		// One (message, user) at a time, so concurrent adds can't both pass the limit
+		if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1, $2)", messageID, userID); err != nil {
+			return 0, err
+		}
+		res, err := tx.ExecContext(ctx, `
+            INSERT INTO message_reactions (message_id, user_id, emoji)
+            SELECT $1, $2, $3
+            WHERE (SELECT COUNT(*) FROM message_reactions WHERE message_id = $1 AND user_id = $2) < $4
+            ON CONFLICT DO NOTHING
+        `, messageID, userID, emoji, maxReactionsPerUser)
+		if err != nil {
+			return 0, err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			// Either already there (fine) or over the limit
+			var exists bool
+			err := tx.QueryRowContext(ctx,
+				"SELECT EXISTS (SELECT 1 FROM message_reactions WHERE message_id = $1 AND user_id = $2 AND emoji = $3)",
+				messageID, userID, emoji,
+			).Scan(&exists)
+			if err != nil {
+				return 0, err
+			}
+			if !exists {
+				return 0, ErrTooManyReactions
+			}
+		}
+	} else {
+		_, err = tx.ExecContext(ctx,
+			"DELETE FROM message_reactions WHERE message_id = $1 AND user_id = $2 AND emoji = $3",
+			messageID, userID, emoji,
+		)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	var count int
+	err = tx.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM message_reactions WHERE message_id = $1 AND emoji = $2",
+		messageID, emoji,
+	).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+	return count, tx.Commit()
+}
+
+// attachReactions fills Message.Reactions for a page of history in one query,
+// oldest emoji first.
+func (r *Repository) attachReactions(ctx context.Context, messages []*Message, viewerID int) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	byID := make(map[int]*Message, len(messages))
+	ids := make([]int, 0, len(messages))
+	for _, m := range messages {
+		byID[m.ID] = m
+		ids = append(ids, m.ID)
+	}
+
+	query := `
+        SELECT message_id, emoji, COUNT(*), BOOL_OR(user_id = $2)
+        FROM message_reactions
+        WHERE message_id = ANY($1)
+        GROUP BY message_id, emoji
+        ORDER BY MIN(created_at)
+    `
+	rows, err := r.db.QueryContext(ctx, query, ids, viewerID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var messageID int
+		var rs ReactionSummary
+		if err := rows.Scan(&messageID, &rs.Emoji, &rs.Count, &rs.Me); err != nil {
+			return err
+		}
+		if m, ok := byID[messageID]; ok {
+			m.Reactions = append(m.Reactions, rs)
+		}
+	}
+	return rows.Err()
+}
+
+// attachmentColumns is the SELECT list scanAttachment expects ("a" = attachments).
+const attachmentColumns = `a.id, a.conversation_id, a.message_id, a.uploader_id, a.filename, a.mime_type, a.size_bytes, a.sha256, a.storage_key, a.created_at,
+        COALESCE(a.width, 0), COALESCE(a.height, 0), COALESCE(a.blurhash, ''), COALESCE(a.thumbnail_status, '')`
+
+func scanAttachment(row rowScanner) (*Attachment, error) {
+	a := &Attachment{}
+	var messageID sql.NullInt64
+	err := row.Scan(&a.ID, &a.ConversationID, &messageID, &a.UploaderID, &a.Filename, &a.MimeType, &a.Size, &a.SHA256, &a.storageKey, &a.CreatedAt,
+		&a.Width, &a.Height, &a.Blurhash, &a.ThumbnailStatus)
+	if err != nil {
+		return nil, err
+	}
+	if messageID.Valid {
+		id := int(messageID.Int64)
+		a.MessageID = &id
+	}
+	a.URL = fmt.Sprintf("/api/attachments/%d", a.ID)
+	return a, nil
+}
+
+// CreateAttachment records an upload whose bytes are already in the BlobStore.
+func (r *Repository) CreateAttachment(ctx context.Context, a *Attachment) (*Attachment, error) {
+	query := `
+        INSERT INTO attachments AS a (conversation_id, uploader_id, filename, mime_type, size_bytes, sha256, storage_key, thumbnail_status)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, NULLIF($8, ''))
+        RETURNING ` + attachmentColumns
+	return scanAttachment(r.db.QueryRowContext(ctx, query, a.ConversationID, a.UploaderID, a.Filename, a.MimeType, a.Size, a.SHA256, a.storageKey, a.ThumbnailStatus))
+}
+
+// GetAttachment finds an upload, unless the message it was sent with has been deleted for everyone.
+func (r *Repository) GetAttachment(ctx context.Context, attachmentID int) (*Attachment, error) {
+	query := `
+        SELECT ` + attachmentColumns + `
+        FROM attachments a
+        LEFT JOIN messages m ON m.id = a.message_id
+        WHERE a.id = $1 AND m.deleted_at IS NULL
+    `
+	a, err := scanAttachment(r.db.QueryRowContext(ctx, query, attachmentID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrAttachmentNotFound
+	}
+	return a, err
+}
+
+// CountUnsentAttachments counts how many of ids the user uploaded to the
+// conversation and hasn't sent yet, i.e. may put on a new message.
+func (r *Repository) CountUnsentAttachments(ctx context.Context, conversationID, uploaderID int, ids []int) (int, error) {
+	query := `
+        SELECT COUNT(*) FROM attachments
+        WHERE id = ANY($1) AND conversation_id = $2 AND uploader_id = $3 AND message_id IS NULL
+    `
+	var n int
+	err := r.db.QueryRowContext(ctx, query, ids, conversationID, uploaderID).Scan(&n)
+	return n, err
+}
+
+// attachAttachments fills in Attachments for a batch of messages in one query.
+func (r *Repository) attachAttachments(ctx context.Context, messages []*Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	byID := make(map[int]*Message, len(messages))
+	ids := make([]int, 0, len(messages))
+	for _, m := range messages {
+		byID[m.ID] = m
+		ids = append(ids, m.ID)
+	}
+
+	// Tombstones keep no files
+	query := `
+        SELECT ` + attachmentColumns + `
+        FROM attachments a
+        JOIN messages m ON m.id = a.message_id
+        WHERE a.message_id = ANY($1) AND m.deleted_at IS NULL
+        ORDER BY a.id
+    `
+	rows, err := r.db.QueryContext(ctx, query, ids)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var all []*Attachment
+	for rows.Next() {
+		a, err := scanAttachment(rows)
+		if err != nil {
+			return err
+		}
+		if m, ok := byID[*a.MessageID]; ok {
+			m.Attachments = append(m.Attachments, a)
+			all = append(all, a)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return r.attachThumbnails(ctx, all)
+}
+
+// attachThumbnails fills in Thumbnails for a batch of attachments in one query.
+func (r *Repository) attachThumbnails(ctx context.Context, attachments []*Attachment) error {
+	byID := make(map[int]*Attachment, len(attachments))
+	ids := make([]int, 0, len(attachments))
+	for _, a := range attachments {
+		if a.ThumbnailStatus == ThumbnailReady {
+			byID[a.ID] = a
+			ids = append(ids, a.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	query := `SELECT attachment_id, size, width, height FROM attachment_thumbnails WHERE attachment_id = ANY($1) ORDER BY size`
+	rows, err := r.db.QueryContext(ctx, query, ids)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var attachmentID int
+		var t Thumbnail
+		if err := rows.Scan(&attachmentID, &t.Size, &t.Width, &t.Height); err != nil {
+			return err
+		}
+		t.URL = fmt.Sprintf("/api/attachments/%d/thumbnails/%d", attachmentID, t.Size)
+		if a, ok := byID[attachmentID]; ok {
+			a.Thumbnails = append(a.Thumbnails, t)
+		}
+	}
+	return rows.Err()
+}
+
+// GetThumbnail finds one rendered size of an attachment.
+func (r *Repository) GetThumbnail(ctx context.Context, attachmentID, size int) (*Thumbnail, error) {
+	t := &Thumbnail{Size: size}
+	query := `SELECT width, height, size_bytes, storage_key FROM attachment_thumbnails WHERE attachment_id = $1 AND size = $2`
+	err := r.db.QueryRowContext(ctx, query, attachmentID, size).Scan(&t.Width, &t.Height, &t.bytes, &t.storageKey)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrAttachmentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	t.URL = fmt.Sprintf("/api/attachments/%d/thumbnails/%d", attachmentID, size)
+	return t, nil
+}
+
+// SaveThumbnails records an image's dimensions, placeholder and rendered
+// thumbnails (already in the BlobStore) and marks it ready, all at once.
+func (r *Repository) SaveThumbnails(ctx context.Context, attachmentID, width, height int, blurhash string, thumbs []Thumbnail) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, t := range thumbs {
+		_, err := tx.ExecContext(ctx, `
+            INSERT INTO attachment_thumbnails (attachment_id, size, width, height, size_bytes, storage_key)
+            VALUES ($1, $2, $3, $4, $5, $6)
+            ON CONFLICT (attachment_id, size) DO UPDATE
+            SET width = EXCLUDED.width, height = EXCLUDED.height, size_bytes = EXCLUDED.size_bytes, storage_key = EXCLUDED.storage_key
+        `, attachmentID, t.Size, t.Width, t.Height, t.bytes, t.storageKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx,
+		"UPDATE attachments SET width = $2, height = $3, blurhash = $4, thumbnail_status = $5 WHERE id = $1",
+		attachmentID, width, height, blurhash, ThumbnailReady,
+	)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SetThumbnailStatus marks an image as failed (undecodable) so it isn't retried.
+func (r *Repository) SetThumbnailStatus(ctx context.Context, attachmentID int, status string) error {
+	_, err := r.db.ExecContext(ctx, "UPDATE attachments SET thumbnail_status = $2 WHERE id = $1", attachmentID, status)
+	return err
+}
+
+// PendingThumbnails lists images still waiting for thumbnails, oldest first,
+// e.g. because the node restarted before getting to them.
+func (r *Repository) PendingThumbnails(ctx context.Context) ([]int, error) {
+	rows, err := r.db.QueryContext(ctx, "SELECT id FROM attachments WHERE thumbnail_status = $1 ORDER BY id", ThumbnailPending)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// GetMessageEdits returns a message's earlier versions, oldest first.
+func (r *Repository) GetMessageEdits(ctx context.Context, messageID int) ([]MessageEdit, error) {
+	query := `SELECT message_id, content, edited_at FROM message_edits WHERE message_id = $1 ORDER BY id ASC`
+	rows, err := r.db.QueryContext(ctx, query, messageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	edits := []MessageEdit{}
+	for rows.Next() {
+		var e MessageEdit
+		if err := rows.Scan(&e.MessageID, &e.Content, &e.EditedAt); err != nil {
+			return nil, err
+		}
+		edits = append(edits, e)
+	}
+	return edits, rows.Err()
+}
+
+// MarkReceipt records that userID got (or read) a message. Timestamps only
+// move forward: a "read" implies "delivered", and neither is ever overwritten.
+func (r *Repository) MarkReceipt(ctx context.Context, messageID, userID int, status string) (*Receipt, error) {
+	query := `
+        INSERT INTO message_receipts (message_id, user_id, delivered_at, read_at)
+        VALUES ($1, $2, NOW(), CASE WHEN $3::text = 'read' THEN NOW() END)
+        ON CONFLICT (message_id, user_id) DO UPDATE SET
+            delivered_at = COALESCE(message_receipts.delivered_at, EXCLUDED.delivered_at),
+            read_at = COALESCE(message_receipts.read_at, EXCLUDED.read_at)
+        RETURNING message_id, user_id, delivered_at, read_at
+    `
+	rc := &Receipt{}
+	err := r.db.QueryRowContext(ctx, query, messageID, userID, status).Scan(&rc.MessageID, &rc.UserID, &rc.DeliveredAt, &rc.ReadAt)
+	if err != nil {
+		return nil, err
+	}
+	return rc, nil
+}
+
+// attachReceipts fills Message.Receipts for a page of history in one query.
+func (r *Repository) attachReceipts(ctx context.Context, messages []*Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	byID := make(map[int]*Message, len(messages))
+	ids := make([]int, 0, len(messages))
+	for _, m := range messages {
+		byID[m.ID] = m
+		ids = append(ids, m.ID)
+	}
+
+	query := `SELECT message_id, user_id, delivered_at, read_at FROM message_receipts WHERE message_id = ANY($1) ORDER BY user_id`
+	rows, err := r.db.QueryContext(ctx, query, ids)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var rc Receipt
+		if err := rows.Scan(&rc.MessageID, &rc.UserID, &rc.DeliveredAt, &rc.ReadAt); err != nil {
+			return err
+		}
+		if m, ok := byID[rc.MessageID]; ok {
+			m.Receipts = append(m.Receipts, rc)
+		}
+	}
+	return rows.Err()
+}
+
+// previewLength caps message previews (inbox, reply quotes) in runes
+const previewLength = 100
+
+// preview shortens content to previewLength runes for list views.
+func preview(content string) string {
+	runes := []rune(content)
+	if len(runes) <= previewLength {
+		return content
+	}
+	return string(runes[:previewLength]) + "…"
+}
+
+// ListConversations is the inbox: every conversation the user is in, with its
+// latest message and unread count, most recently active first.
+func (r *Repository) ListConversations(ctx context.Context, userID int) ([]*ConversationSummary, error) {
+	query := `
+        SELECT c.id, c.type, COALESCE(c.name, ''),
+               lm.id, lm.seq, lm.content, lm.created_at, lm.deleted_at, lm.sender_id, lu.username,
+               COALESCE(lm.created_at, c.created_at) AS last_activity,
+               (SELECT COUNT(*) FROM messages m
+                WHERE m.conversation_id = c.id
+                AND m.id > p.last_read_message_id
+                AND m.sender_id <> $1
+                AND m.deleted_at IS NULL
+                AND NOT EXISTS (SELECT 1 FROM message_hidden h WHERE h.message_id = m.id AND h.user_id = $1)) AS unread_count
+        FROM participants p
+        JOIN conversations c ON c.id = p.conversation_id
+        LEFT JOIN LATERAL (
+            SELECT id, seq, content, created_at, deleted_at, sender_id FROM messages
+            WHERE conversation_id = c.id
+            AND NOT EXISTS (SELECT 1 FROM message_hidden h WHERE h.message_id = messages.id AND h.user_id = $1)
+            ORDER BY id DESC
+            LIMIT 1
+        ) lm ON true
+        LEFT JOIN users lu ON lu.id = lm.sender_id
+        WHERE p.user_id = $1
+        ORDER BY last_activity DESC, c.id DESC
+    `
+	rows, err := r.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	summaries := []*ConversationSummary{}
+	byID := make(map[int]*ConversationSummary)
+	var ids []int
+	for rows.Next() {
+		s := &ConversationSummary{Participants: []ParticipantInfo{}}
+		var (
+			msgID, seq      sql.NullInt64
+			senderID        sql.NullInt64
+			content, sender sql.NullString
+			sentAt          sql.NullTime
+			deletedAt       *time.Time
+		)
+		if err := rows.Scan(&s.ID, &s.Type, &s.Name, &msgID, &seq, &content, &sentAt, &deletedAt, &senderID, &sender, &s.LastActivity, &s.UnreadCount); err != nil {
+			return nil, err
+		}
+		if msgID.Valid {
+			s.LastMessage = &Message{
+				ID:             int(msgID.Int64),
+				ConversationID: s.ID,
+				Seq:            seq.Int64,
+				UserID:         int(senderID.Int64),
+				Username:       sender.String,
+				Content:        preview(content.String),
+				CreatedAt:      sentAt.Time,
+				DeletedAt:      deletedAt,
+			}
+		}
+		summaries = append(summaries, s)
+		byID[s.ID] = s
+		ids = append(ids, s.ID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return summaries, nil
+	}
+
+	// Fill in who is in each conversation with one more query
+	pRows, err := r.db.QueryContext(ctx, `
+        SELECT p.conversation_id, u.id, u.username
+        FROM participants p
+        JOIN users u ON u.id = p.user_id
+        WHERE p.conversation_id = ANY($1)
+        ORDER BY p.joined_at ASC
+    `, ids)
+	if err != nil {
+		return nil, err
+	}
+	defer pRows.Close()
+
+	for pRows.Next() {
+		var conversationID int
+		var info ParticipantInfo
+		if err := pRows.Scan(&conversationID, &info.UserID, &info.Username); err != nil {
+			return nil, err
+		}
+		byID[conversationID].Participants = append(byID[conversationID].Participants, info)
+	}
+	if err := pRows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Image previews come with their thumbnails, so the inbox never needs the full file
+	var lastMessages []*Message
+	for _, s := range summaries {
+		if s.LastMessage != nil {
+			lastMessages = append(lastMessages, s.LastMessage)
+		}
+	}
+	return summaries, r.attachAttachments(ctx, lastMessages)
+}
+
+// MarkConversationRead moves the user's read pointer forward to messageID
+// (never backwards, and never past the conversation's latest message).
+func (r *Repository) MarkConversationRead(ctx context.Context, conversationID, userID, messageID int) error {
+	query := `
+        UPDATE participants
+        SET last_read_message_id = GREATEST(
+            last_read_message_id,
+            LEAST($3, (SELECT COALESCE(MAX(id), 0) FROM messages WHERE conversation_id = $1))
+        )
+        WHERE conversation_id = $1 AND user_id = $2
+    `
+	res, err := r.db.ExecContext(ctx, query, conversationID, userID, messageID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotParticipant
+	}
+	return nil
+}
+
+// GetContacts returns everyone who shares at least one conversation with the user.
+func (r *Repository) GetContacts(ctx context.Context, userID int) ([]int, error) {
+	query := `
+        SELECT DISTINCT p2.user_id
+        FROM participants p1
+        JOIN participants p2 ON p1.conversation_id = p2.conversation_id
+        WHERE p1.user_id = $1 AND p2.user_id <> $1
+    `
+	rows, err := r.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var userIDs []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		userIDs = append(userIDs, id)
+	}
+	return userIDs, rows.Err()
+}
+
+// SharesConversation reports whether two users are participants of at least one common conversation.
+func (r *Repository) SharesConversation(ctx context.Context, userID, otherID int) (bool, error) {
+	query := `
+        SELECT EXISTS (
+            SELECT 1
+            FROM participants p1
+            JOIN participants p2 ON p1.conversation_id = p2.conversation_id
+            WHERE p1.user_id = $1 AND p2.user_id = $2
+        )
+    `
+	var shared bool
+	err := r.db.QueryRowContext(ctx, query, userID, otherID).Scan(&shared)
+	return shared, err
 }
 
 func (r *Repository) GetConversationParticipants(ctx context.Context, conversationID int) ([]int, error) {
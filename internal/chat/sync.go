@@ -0,0 +1,146 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	syncPageSize = 200
+	// After this many messages we stop streaming and tell the client to page
+	// through /api/messages instead.
+	maxSyncMessages = 5000
+	// Live frames held back while a client catches up. Beyond this it's cheaper
+	// to drop the connection and let the client reconnect with a newer marker.
+	maxPendingFrames = 1000
+	// Conversations a client may list in ?seqs=
+	maxSyncConversations = 1000
+)
+
+// syncDone tells the Hub a client finished catching up, and which messages it sent.
+type syncDone struct {
+	client  *Client
+	sentIDs map[int]bool
+}
+
+// catchUp streams every message the user missed, across all of their
+// conversations, oldest first: after SyncSeqs where the client has a position
+// in the conversation, after SyncSince elsewhere. It runs at the start of ReadPump:
+// while it runs the Hub holds this client's live frames back, and releases
+// them once we report in on its syncDone channel.
+func (c *Client) catchUp() {
+	ctx := context.Background()
+	lastID := 0
+	sent := 0
+	// IDs are assigned before commit, so a lower ID can show up live after we
+	// paged past it: remember exactly what we sent instead of a watermark
+	sentIDs := make(map[int]bool)
+	truncated := false
+
+	for {
+		messages, err := c.Hub.repo.GetMessagesSince(ctx, c.UserID, c.SyncSince, c.SyncSeqs, lastID, syncPageSize)
+		if err != nil {
+			log.Printf("❌ Catch-up failed for user %d: %v", c.UserID, err)
+			c.sendFrame(newErrorFrame("", ErrCodeInternal, "failed to sync missed messages", 0))
+			break
+		}
+
+		for _, msg := range messages {
+			if !c.sendFrameWait(newFrame(FrameMessage, "", msg)) {
+				return // Connection is gone; ReadPump will unregister it
+			}
+			lastID = msg.ID
+			sentIDs[msg.ID] = true
+			sent++
+		}
+
+		if len(messages) < syncPageSize {
+			break
+		}
+		if sent >= maxSyncMessages {
+			truncated = true
+			break
+		}
+	}
+
+	c.sendFrameWait(newFrame(FrameSync, "", SyncFrame{
+		LastMessageID: max(lastID, c.SyncSince),
+		Count:         sent,
+		Truncated:     truncated,
+	}))
+	c.Hub.shardFor(c.UserID).syncDone <- &syncDone{client: c, sentIDs: sentIDs}
+}
+
+// needsCatchUp reports whether the client asked to replay missed messages.
+func (c *Client) needsCatchUp() bool {
+	return c.SyncSince > 0 || len(c.SyncSeqs) > 0
+}
+
+// parseSyncSeqs reads ?seqs=<conversation>:<seq>,... (the last seq the client
+// has in each conversation it knows).
+func parseSyncSeqs(raw string) (map[int]int64, error) {
+	seqs := make(map[int]int64)
+	if raw == "" {
+		return seqs, nil
+	}
+	for _, pair := range strings.Split(raw, ",") {
+		convRaw, seqRaw, ok := strings.Cut(pair, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid entry %q", pair)
+		}
+		conv, err := strconv.Atoi(convRaw)
+		if err != nil || conv <= 0 {
+			return nil, fmt.Errorf("invalid conversation %q", convRaw)
+		}
+		seq, err := strconv.ParseInt(seqRaw, 10, 64)
+		if err != nil || seq < 0 {
+			return nil, fmt.Errorf("invalid seq %q", seqRaw)
+		}
+		seqs[conv] = seq
+	}
+	if len(seqs) > maxSyncConversations {
+		return nil, fmt.Errorf("more than %d conversations", maxSyncConversations)
+	}
+	return seqs, nil
+}
+
+// sendFrameWait is sendFrame for bulk output: it waits for WritePump to make
+// room instead of giving up straight away.
+func (c *Client) sendFrameWait(payload []byte) bool {
+	timer := time.NewTimer(writeWait)
+	defer timer.Stop()
+
+	select {
+	case c.Send <- payload:
+		return true
+	case <-timer.C:
+		c.Conn.Close()
+		return false
+	}
+}
+
+// flushPending releases the live frames held back during catch-up, skipping
+// messages the catch-up already delivered. Must only be called from the shard's run().
+func (s *shard) flushPending(client *Client, sentIDs map[int]bool) {
+	pending := client.pending
+	client.pending = nil
+	client.syncing = false
+
+	for _, payload := range pending {
+		var frame struct {
+			Type string `json:"type"`
+			Data struct {
+				ID int `json:"id"`
+			} `json:"data"`
+		}
+		if json.Unmarshal(payload, &frame) == nil && frame.Type == FrameMessage && sentIDs[frame.Data.ID] {
+			continue // Already sent by catchUp
+		}
+		s.sendToClient(client, payload)
+	}
+}
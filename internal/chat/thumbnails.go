@@ -0,0 +1,150 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+
+	"go-chat/internal/media"
+	"go-chat/internal/storage"
+)
+
+const (
+	thumbnailWorkers   = 2
+	thumbnailQueueSize = 256
+)
+
+// Thumbnailer renders thumbnails and a blurhash for image uploads in the
+// background, so uploads return right away and nobody waits on decoding.
+// Anything it doesn't get to (full queue, restart) stays "pending" in the DB
+// and is picked up again on the next start. Rendering twice is harmless.
+type Thumbnailer struct {
+	repo  *Repository
+	blobs storage.BlobStore
+	hub   *Hub
+	jobs  chan int // Attachment IDs
+}
+
+func NewThumbnailer(repo *Repository, blobs storage.BlobStore, hub *Hub) *Thumbnailer {
+	return &Thumbnailer{
+		repo:  repo,
+		blobs: blobs,
+		hub:   hub,
+		jobs:  make(chan int, thumbnailQueueSize),
+	}
+}
+
+// Run starts the workers and requeues leftovers from before a restart. Blocks forever.
+func (t *Thumbnailer) Run() {
+	for i := 1; i < thumbnailWorkers; i++ {
+		go t.work()
+	}
+	go t.requeuePending()
+	t.work()
+}
+
+// Enqueue asks for thumbnails without ever blocking the upload request.
+func (t *Thumbnailer) Enqueue(attachmentID int) {
+	select {
+	case t.jobs <- attachmentID:
+	default:
+		log.Printf("⚠️ Thumbnail queue full, attachment %d stays pending until restart", attachmentID)
+	}
+}
+
+func (t *Thumbnailer) requeuePending() {
+	ids, err := t.repo.PendingThumbnails(context.Background())
+	if err != nil {
+		log.Printf("❌ Failed to load pending thumbnails: %v", err)
+		return
+	}
+	for _, id := range ids {
+		t.jobs <- id // Workers are running, so this just waits for room
+	}
+}
+
+func (t *Thumbnailer) work() {
+	for id := range t.jobs {
+		if err := t.render(context.Background(), id); err != nil {
+			log.Printf("❌ Thumbnails for attachment %d failed: %v", id, err)
+			t.repo.SetThumbnailStatus(context.Background(), id, ThumbnailFailed)
+		}
+	}
+}
+
+func (t *Thumbnailer) render(ctx context.Context, attachmentID int) error {
+	// 1. Load and decode the original
+	att, err := t.repo.GetAttachment(ctx, attachmentID)
+	if err != nil {
+		return err
+	}
+	body, err := t.blobs.Get(ctx, att.storageKey)
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(body)
+	body.Close()
+	if err != nil {
+		return err
+	}
+	img, err := media.Decode(data)
+	if err != nil {
+		return err
+	}
+
+	// 2. Render each size, largest first, shrinking the previous one (cheaper than starting from the original)
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	thumbs := make([]Thumbnail, len(thumbnailSizes))
+	src := img
+	for i := len(thumbnailSizes) - 1; i >= 0; i-- {
+		size := thumbnailSizes[i]
+		w, h := media.Fit(width, height, size)
+		src = media.Downscale(src, w, h)
+
+		jpg, err := media.EncodeJPEG(src)
+		if err != nil {
+			return err
+		}
+		key := fmt.Sprintf("%s.thumb%d.jpg", att.storageKey, size)
+		if err := t.blobs.Put(ctx, key, bytes.NewReader(jpg), int64(len(jpg)), "image/jpeg"); err != nil {
+			return err
+		}
+		thumbs[i] = Thumbnail{Size: size, Width: w, Height: h, bytes: int64(len(jpg)), storageKey: key}
+	}
+
+	// 3. The smallest thumbnail is plenty for the placeholder
+	if err := t.repo.SaveThumbnails(ctx, att.ID, width, height, media.Blurhash(src), thumbs); err != nil {
+		return err
+	}
+	log.Printf("🖼️ Rendered %d thumbnails for attachment %d (%dx%d)", len(thumbs), att.ID, width, height)
+
+	// 4. Sent before we finished? Push the previews to everyone who got the message.
+	t.announce(ctx, att.ID)
+	return nil
+}
+
+// announce sends an "attachment" frame with the finished previews if the
+// attachment is already on a message. If it isn't, SaveMessage picks them up
+// along with the rest of the attachment when it is sent.
+func (t *Thumbnailer) announce(ctx context.Context, attachmentID int) {
+	att, err := t.repo.GetAttachment(ctx, attachmentID)
+	if errors.Is(err, ErrAttachmentNotFound) || (err == nil && att.MessageID == nil) {
+		return // Deleted meanwhile, or not sent yet
+	}
+	if err == nil {
+		err = t.repo.attachThumbnails(ctx, []*Attachment{att})
+	}
+	if err != nil {
+		log.Printf("❌ Failed to announce thumbnails for attachment %d: %v", attachmentID, err)
+		return
+	}
+
+	t.hub.publishEvent(&Event{
+		ConversationID: att.ConversationID,
+		Type:           FrameAttachment,
+		Data:           att,
+	})
+}
@@ -59,6 +59,109 @@ func (d *Database) AutoMigrate() error {
             content TEXT NOT NULL,
             created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
         )`,
+
+		// Group conversations: a display name, who created it, and per-member roles.
+		`ALTER TABLE conversations ADD COLUMN IF NOT EXISTS name VARCHAR(100)`,
+		`ALTER TABLE conversations ADD COLUMN IF NOT EXISTS created_by INT REFERENCES users(id) ON DELETE SET NULL`,
+		`ALTER TABLE participants ADD COLUMN IF NOT EXISTS role VARCHAR(10) CHECK (role IN ('admin', 'member')) DEFAULT 'member'`,
+
+		// Per-participant read pointer: everything after it counts as unread
+		`ALTER TABLE participants ADD COLUMN IF NOT EXISTS last_read_message_id INT NOT NULL DEFAULT 0`,
+
+		// Per-conversation, gapless message sequence numbers. Existing rows are
+		// numbered once by ID, then SaveMessage takes over.
+		`ALTER TABLE conversations ADD COLUMN IF NOT EXISTS last_seq BIGINT NOT NULL DEFAULT 0`,
+		`ALTER TABLE messages ADD COLUMN IF NOT EXISTS seq BIGINT`,
+		`UPDATE messages m SET seq = numbered.rn
+         FROM (SELECT id, ROW_NUMBER() OVER (PARTITION BY conversation_id ORDER BY id) AS rn FROM messages
+               WHERE conversation_id IN (SELECT conversation_id FROM messages WHERE seq IS NULL)) numbered
+         WHERE m.id = numbered.id AND m.seq IS NULL`,
+		`UPDATE conversations c SET last_seq = numbered.max_seq
+         FROM (SELECT conversation_id, MAX(seq) AS max_seq FROM messages GROUP BY conversation_id) numbered
+         WHERE c.id = numbered.conversation_id AND c.last_seq < numbered.max_seq`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_messages_conversation_seq ON messages (conversation_id, seq)`,
+
+		// Client-generated message IDs make resends idempotent (per sender and conversation)
+		`ALTER TABLE messages ADD COLUMN IF NOT EXISTS client_msg_id VARCHAR(64)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_messages_sender_conv_client_msg_id ON messages (sender_id, conversation_id, client_msg_id) WHERE client_msg_id IS NOT NULL`,
+		// Replaced by the index above: a key reused in another conversation is a new message
+		`DROP INDEX IF EXISTS idx_messages_sender_client_msg_id`,
+
+		// Editing: the live row carries edited_at, earlier versions are archived
+		`ALTER TABLE messages ADD COLUMN IF NOT EXISTS edited_at TIMESTAMP`,
+		`CREATE TABLE IF NOT EXISTS message_edits (
+            id SERIAL PRIMARY KEY,
+            message_id INT REFERENCES messages(id) ON DELETE CASCADE,
+            content TEXT NOT NULL,
+            edited_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+        )`,
+		`CREATE INDEX IF NOT EXISTS idx_message_edits_message_id ON message_edits (message_id)`,
+
+		// Deleting: "for everyone" leaves a tombstone, "for me" just hides it from one user
+		`ALTER TABLE messages ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP`,
+		`CREATE TABLE IF NOT EXISTS message_hidden (
+            message_id INT REFERENCES messages(id) ON DELETE CASCADE,
+            user_id INT REFERENCES users(id) ON DELETE CASCADE,
+            hidden_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            PRIMARY KEY (message_id, user_id)
+        )`,
+
+		`CREATE TABLE IF NOT EXISTS message_reactions (
+            message_id INT REFERENCES messages(id) ON DELETE CASCADE,
+            user_id INT REFERENCES users(id) ON DELETE CASCADE,
+            emoji VARCHAR(32) NOT NULL,
+            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            PRIMARY KEY (message_id, user_id, emoji)
+        )`,
+
+		// History is paged by (conversation_id, id)
+		`CREATE INDEX IF NOT EXISTS idx_messages_conversation_id ON messages (conversation_id, id)`,
+
+		`CREATE TABLE IF NOT EXISTS message_receipts (
+            message_id INT REFERENCES messages(id) ON DELETE CASCADE,
+            user_id INT REFERENCES users(id) ON DELETE CASCADE,
+            delivered_at TIMESTAMP,
+            read_at TIMESTAMP,
+            PRIMARY KEY (message_id, user_id)
+        )`,
+
+		// Replies point at their parent; threads walk this index
+		`ALTER TABLE messages ADD COLUMN IF NOT EXISTS reply_to_id INT REFERENCES messages(id) ON DELETE SET NULL`,
+		`CREATE INDEX IF NOT EXISTS idx_messages_reply_to_id ON messages (reply_to_id) WHERE reply_to_id IS NOT NULL`,
+
+		// Full-text search over message content
+		`ALTER TABLE messages ADD COLUMN IF NOT EXISTS content_tsv tsvector GENERATED ALWAYS AS (to_tsvector('english', content)) STORED`,
+		`CREATE INDEX IF NOT EXISTS idx_messages_content_tsv ON messages USING GIN (content_tsv)`,
+
+		// Uploaded files; message_id is set once they are sent
+		`CREATE TABLE IF NOT EXISTS attachments (
+            id SERIAL PRIMARY KEY,
+            conversation_id INT REFERENCES conversations(id) ON DELETE CASCADE,
+            message_id INT REFERENCES messages(id) ON DELETE CASCADE,
+            uploader_id INT REFERENCES users(id) ON DELETE CASCADE,
+            filename VARCHAR(255) NOT NULL,
+            mime_type VARCHAR(255) NOT NULL,
+            size_bytes BIGINT NOT NULL,
+            sha256 CHAR(64) NOT NULL,
+            storage_key TEXT NOT NULL,
+            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+        )`,
+		`CREATE INDEX IF NOT EXISTS idx_attachments_message_id ON attachments (message_id)`,
+
+		// Image previews, rendered in the background after upload
+		`ALTER TABLE attachments ADD COLUMN IF NOT EXISTS width INT`,
+		`ALTER TABLE attachments ADD COLUMN IF NOT EXISTS height INT`,
+		`ALTER TABLE attachments ADD COLUMN IF NOT EXISTS blurhash VARCHAR(64)`,
+		`ALTER TABLE attachments ADD COLUMN IF NOT EXISTS thumbnail_status VARCHAR(16)`,
+		`CREATE TABLE IF NOT EXISTS attachment_thumbnails (
+            attachment_id INT REFERENCES attachments(id) ON DELETE CASCADE,
+            size INT NOT NULL,
+            width INT NOT NULL,
+            height INT NOT NULL,
+            size_bytes BIGINT NOT NULL,
+            storage_key TEXT NOT NULL,
+            PRIMARY KEY (attachment_id, size)
+        )`,
 	}
 
 	for _, query := range queries {
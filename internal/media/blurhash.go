@@ -0,0 +1,112 @@
+package media
+
+import (
+	"image"
+	"math"
+	"strings"
+)
+
+// blurhashSample is the edge we shrink to before encoding; the hash only
+// keeps a handful of cosine components, so more pixels add nothing.
+const blurhashSample = 32
+
+// Blurhash encodes img as a short string (https://blurha.sh) that clients
+// decode into a blurry placeholder while the real thumbnail loads.
+// Four components along the long edge, three along the short one.
+func Blurhash(img *image.RGBA) string {
+	b := img.Bounds()
+	cx, cy := 4, 3
+	if b.Dy() > b.Dx() {
+		cx, cy = 3, 4
+	}
+
+	w, h := Fit(b.Dx(), b.Dy(), blurhashSample)
+	small := Downscale(img, w, h)
+
+	// One (r, g, b) factor per cosine component, in linear light
+	factors := make([][3]float64, 0, cx*cy)
+	for j := 0; j < cy; j++ {
+		for i := 0; i < cx; i++ {
+			factors = append(factors, basisFactor(small, i, j))
+		}
+	}
+
+	var sb strings.Builder
+	sb.WriteString(base83((cx-1)+(cy-1)*9, 1))
+
+	dc, ac := factors[0], factors[1:]
+	maxValue := 1.0
+	if len(ac) > 0 {
+		actualMax := 0.0
+		for _, f := range ac {
+			actualMax = math.Max(actualMax, math.Max(math.Abs(f[0]), math.Max(math.Abs(f[1]), math.Abs(f[2]))))
+		}
+		quantised := int(math.Max(0, math.Min(82, math.Floor(actualMax*166-0.5))))
+		maxValue = float64(quantised+1) / 166
+		sb.WriteString(base83(quantised, 1))
+	} else {
+		sb.WriteString(base83(0, 1))
+	}
+
+	sb.WriteString(base83(linearToSRGB(dc[0])<<16+linearToSRGB(dc[1])<<8+linearToSRGB(dc[2]), 4))
+	for _, f := range ac {
+		q := func(v float64) int {
+			return int(math.Max(0, math.Min(18, math.Floor(signPow(v/maxValue, 0.5)*9+9.5))))
+		}
+		sb.WriteString(base83(q(f[0])*19*19+q(f[1])*19+q(f[2]), 2))
+	}
+	return sb.String()
+}
+
+func basisFactor(img *image.RGBA, i, j int) [3]float64 {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	var r, g, b float64
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			basis := math.Cos(math.Pi*float64(i)*float64(x)/float64(w)) * math.Cos(math.Pi*float64(j)*float64(y)/float64(h))
+			off := img.PixOffset(x, y)
+			r += basis * sRGBToLinear(img.Pix[off])
+			g += basis * sRGBToLinear(img.Pix[off+1])
+			b += basis * sRGBToLinear(img.Pix[off+2])
+		}
+	}
+
+	norm := 2.0
+	if i == 0 && j == 0 {
+		norm = 1
+	}
+	scale := norm / float64(w*h)
+	return [3]float64{r * scale, g * scale, b * scale}
+}
+
+func sRGBToLinear(v uint8) float64 {
+	f := float64(v) / 255
+	if f <= 0.04045 {
+		return f / 12.92
+	}
+	return math.Pow((f+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(v float64) int {
+	v = math.Max(0, math.Min(1, v))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
+
+const base83Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// base83 writes value as exactly length digits of blurhash's alphabet.
+func base83(value, length int) string {
+	out := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		out[i] = base83Chars[value%83]
+		value /= 83
+	}
+	return string(out)
+}
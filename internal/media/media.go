@@ -0,0 +1,112 @@
+// Package media turns uploaded images into small previews using only the
+// standard library: decoding, box-filter downscaling, JPEG encoding and
+// blurhash placeholders.
+package media
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif" // Register decoders for image.Decode
+	"image/jpeg"
+	_ "image/png"
+)
+
+// MaxPixels caps what we agree to decode, so a tiny file claiming to be a
+// 100k x 100k image can't eat the server's memory.
+const MaxPixels = 40_000_000
+
+var ErrTooManyPixels = errors.New("image is too large to decode")
+
+// Supported reports whether Decode understands this (sniffed) MIME type.
+func Supported(mimeType string) bool {
+	switch mimeType {
+	case "image/jpeg", "image/png", "image/gif":
+		return true
+	}
+	return false
+}
+
+// Decode reads an image onto an opaque white canvas (JPEG has no alpha).
+func Decode(data []byte) (*image.RGBA, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Width*cfg.Height > MaxPixels {
+		return nil, fmt.Errorf("%w: %dx%d", ErrTooManyPixels, cfg.Width, cfg.Height)
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	b := src.Bounds()
+	canvas := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(canvas, canvas.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(canvas, canvas.Bounds(), src, b.Min, draw.Over)
+	return canvas, nil
+}
+
+// Fit scales w x h down so its longest edge is at most maxEdge, keeping the
+// aspect ratio. Never scales up.
+func Fit(w, h, maxEdge int) (int, int) {
+	if w <= maxEdge && h <= maxEdge {
+		return w, h
+	}
+	if w >= h {
+		return maxEdge, max(1, h*maxEdge/w)
+	}
+	return max(1, w*maxEdge/h), maxEdge
+}
+
+// Downscale shrinks src to w x h by averaging every source pixel that falls
+// into each destination pixel (a box filter: slower than nearest-neighbour,
+// but no aliasing on photos).
+func Downscale(src *image.RGBA, w, h int) *image.RGBA {
+	sb := src.Bounds()
+	sw, sh := sb.Dx(), sb.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+
+	for y := 0; y < h; y++ {
+		y0 := y * sh / h
+		y1 := max((y+1)*sh/h, y0+1)
+		for x := 0; x < w; x++ {
+			x0 := x * sw / w
+			x1 := max((x+1)*sw/w, x0+1)
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				off := src.PixOffset(sb.Min.X+x0, sb.Min.Y+sy)
+				for sx := x0; sx < x1; sx++ {
+					r += uint64(src.Pix[off])
+					g += uint64(src.Pix[off+1])
+					b += uint64(src.Pix[off+2])
+					a += uint64(src.Pix[off+3])
+					off += 4
+					n++
+				}
+			}
+
+			d := dst.PixOffset(x, y)
+			dst.Pix[d] = uint8(r / n)
+			dst.Pix[d+1] = uint8(g / n)
+			dst.Pix[d+2] = uint8(b / n)
+			dst.Pix[d+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
+
+// EncodeJPEG is the thumbnail format: small, and every client can show it.
+func EncodeJPEG(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 80}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
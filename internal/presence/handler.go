@@ -0,0 +1,65 @@
+package presence
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	myMiddleware "go-chat/internal/middleware"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Contacts tells whether two users share a conversation (chat.Repository implements it).
+type Contacts interface {
+	SharesConversation(ctx context.Context, userID, otherID int) (bool, error)
+}
+
+type Handler struct {
+	registry *Registry
+	contacts Contacts
+}
+
+func NewHandler(registry *Registry, contacts Contacts) *Handler {
+	return &Handler{registry: registry, contacts: contacts}
+}
+
+// GetPresence: "Is User B online anywhere?"
+// GET /api/users/{id}/presence
+// Only for the user themselves and their contacts, the same people who get presence pushes.
+func (h *Handler) GetPresence(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid user id", http.StatusBadRequest)
+		return
+	}
+
+	callerID, ok := r.Context().Value(myMiddleware.UserKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if callerID != userID {
+		shared, err := h.contacts.SharesConversation(r.Context(), callerID, userID)
+		if err != nil {
+			http.Error(w, "Failed to fetch presence", http.StatusInternalServerError)
+			return
+		}
+		if !shared {
+			// Same answer as an unknown user, so strangers can't probe who exists
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	status, err := h.registry.Get(r.Context(), userID)
+	if err != nil {
+		http.Error(w, "Failed to fetch presence", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
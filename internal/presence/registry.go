@@ -0,0 +1,101 @@
+package presence
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// DefaultTTL is how long a connection counts as online without a heartbeat.
+// Clients answer a ping roughly every minute, so this leaves room for one slow pong.
+const DefaultTTL = 90 * time.Second
+
+// Status is what the rest of the cluster sees about a user.
+type Status struct {
+	UserID   int        `json:"user_id"`
+	Online   bool       `json:"online"`
+	LastSeen *time.Time `json:"last_seen,omitempty"`
+}
+
+// Registry tracks live connections across all nodes in Redis.
+//
+// Each user has a sorted set "presence:conns:{id}" of connection IDs, scored by
+// the time (unix ms) that connection expires. A node that crashes simply stops
+// heartbeating, so its entries age out instead of leaving ghosts behind.
+type Registry struct {
+	redis *redis.Client
+	ttl   time.Duration
+}
+
+func NewRegistry(redisClient *redis.Client, ttl time.Duration) *Registry {
+	return &Registry{redis: redisClient, ttl: ttl}
+}
+
+// touchScript adds/refreshes a connection and reports whether the user had no
+// live connection before (i.e. just came online).
+// KEYS[1] = conns set, KEYS[2] = last seen; ARGV = now ms, expiry ms, conn ID, ttl ms
+var touchScript = redis.NewScript(`
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', ARGV[1])
+local before = redis.call('ZCARD', KEYS[1])
+redis.call('ZADD', KEYS[1], ARGV[2], ARGV[3])
+redis.call('PEXPIRE', KEYS[1], ARGV[4])
+redis.call('SET', KEYS[2], ARGV[1])
+if before == 0 then return 1 end
+return 0
+`)
+
+// dropScript removes a connection and reports whether it was the user's last one.
+// KEYS[1] = conns set, KEYS[2] = last seen; ARGV = now ms, conn ID
+var dropScript = redis.NewScript(`
+local removed = redis.call('ZREM', KEYS[1], ARGV[2])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', ARGV[1])
+redis.call('SET', KEYS[2], ARGV[1])
+if removed == 1 and redis.call('ZCARD', KEYS[1]) == 0 then return 1 end
+return 0
+`)
+
+// Touch registers a new connection or refreshes an existing one (heartbeat).
+// It returns true when this made the user go from offline to online.
+func (r *Registry) Touch(ctx context.Context, userID int, connID string) (bool, error) {
+	now := time.Now()
+	res, err := touchScript.Run(ctx, r.redis,
+		[]string{connsKey(userID), lastSeenKey(userID)},
+		now.UnixMilli(), now.Add(r.ttl).UnixMilli(), connID, r.ttl.Milliseconds(),
+	).Int()
+	return res == 1, err
+}
+
+// Drop removes a closed connection. It returns true when that was the user's
+// last live connection anywhere in the cluster.
+func (r *Registry) Drop(ctx context.Context, userID int, connID string) (bool, error) {
+	res, err := dropScript.Run(ctx, r.redis,
+		[]string{connsKey(userID), lastSeenKey(userID)},
+		time.Now().UnixMilli(), connID,
+	).Int()
+	return res == 1, err
+}
+
+// Get reports whether a user has any live connection, and when they were last seen.
+func (r *Registry) Get(ctx context.Context, userID int) (*Status, error) {
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+
+	pipe := r.redis.Pipeline()
+	live := pipe.ZCount(ctx, connsKey(userID), "("+now, "+inf")
+	lastSeen := pipe.Get(ctx, lastSeenKey(userID))
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	status := &Status{UserID: userID, Online: live.Val() > 0}
+	if ms, err := lastSeen.Int64(); err == nil {
+		t := time.UnixMilli(ms).UTC()
+		status.LastSeen = &t
+	}
+	return status, nil
+}
+
+func connsKey(userID int) string    { return fmt.Sprintf("presence:conns:%d", userID) }
+func lastSeenKey(userID int) string { return fmt.Sprintf("presence:last_seen:%d", userID) }
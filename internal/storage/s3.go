@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// S3Config points at any S3-compatible endpoint (AWS, MinIO, R2, ...).
+type S3Config struct {
+	Endpoint  string // host[:port], no scheme
+	AccessKey string
+	SecretKey string
+	Bucket    string
+	UseSSL    bool
+}
+
+// S3Store keeps blobs as objects in one bucket, so every app instance shares them.
+type S3Store struct {
+	client *minio.Client
+	bucket string
+}
+
+// NewS3Store connects and creates the bucket if it doesn't exist yet.
+func NewS3Store(ctx context.Context, cfg S3Config) (*S3Store, error) {
+	client, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, ""),
+		Secure: cfg.UseSSL,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("s3 client: %w", err)
+	}
+
+	exists, err := client.BucketExists(ctx, cfg.Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("check bucket %q: %w", cfg.Bucket, err)
+	}
+	if !exists {
+		if err := client.MakeBucket(ctx, cfg.Bucket, minio.MakeBucketOptions{}); err != nil {
+			return nil, fmt.Errorf("create bucket %q: %w", cfg.Bucket, err)
+		}
+	}
+	return &S3Store{client: client, bucket: cfg.Bucket}, nil
+}
+
+// Multipart chunk for uploads of unknown size (size = -1). minio-go buffers
+// one whole part in memory, and without this it sizes parts for a 5 TiB
+// object (~537 MiB each). 5 MiB is the smallest part S3 accepts.
+const s3PartSize = 5 << 20
+
+func (s *S3Store) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	opts := minio.PutObjectOptions{ContentType: contentType}
+	if size < 0 {
+		opts.PartSize = s3PartSize
+	}
+	_, err := s.client.PutObject(ctx, s.bucket, key, r, size, opts)
+	return err
+}
+
+func (s *S3Store) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	// GetObject is lazy: ask for the metadata so a missing key fails here, not mid-response
+	if _, err := s.client.StatObject(ctx, s.bucket, key, minio.StatObjectOptions{}); err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return s.client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+}
+
+func (s *S3Store) Delete(ctx context.Context, key string) error {
+	return s.client.RemoveObject(ctx, s.bucket, key, minio.RemoveObjectOptions{})
+}
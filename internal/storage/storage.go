@@ -0,0 +1,21 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// ErrNotFound is returned by Get when no blob exists under the key.
+var ErrNotFound = errors.New("blob not found")
+
+// BlobStore keeps opaque file contents under slash-separated keys
+// ("attachments/7/3f9a..."). Metadata (MIME type, size, checksum, who may read
+// it) lives in Postgres; the store only moves bytes.
+type BlobStore interface {
+	// Put stores r under key. size is the exact length, or -1 if unknown.
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	// Get opens the blob for reading. The caller closes it.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+}
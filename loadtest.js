@@ -59,8 +59,12 @@ export default function () {
       // Send 5 messages per user session
       for (let i = 0; i < 5; i++) {
         socket.send(JSON.stringify({
-          content: `K6 Load Test Message ${i}`,
-          conversation_id: conversationId,
+          v: 1,
+          type: 'message',
+          data: {
+            content: `K6 Load Test Message ${i}`,
+            conversation_id: conversationId,
+          },
         }));
         // Tiny sleep to mimic human typing speed (and prevent local socket exhaustion)
         sleep(0.5); 
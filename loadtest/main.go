@@ -3,20 +3,28 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
-const (
-	BaseURL   = "http://localhost"
-	WSURL     = "ws://localhost/ws"
-	UserCount = 500 // ⚠️ Start small (50 pairs = 100 users). Database might choke on 1000 immediately.
-	MsgCount  = 20  // Messages per user
+// Flags. Run the same settings against HUB_SHARDS=1 and the default to compare.
+var (
+	BaseURL   = flag.String("base", "http://localhost", "HTTP base URL")
+	WSURL     = flag.String("ws", "ws://localhost/ws", "WebSocket URL")
+	UserCount = flag.Int("pairs", 500, "chatting pairs (each pair is 2 users)") // ⚠️ Start small. Database might choke on 1000 immediately.
+	MsgCount  = flag.Int("msgs", 20, "messages per user")
+	Interval  = flag.Duration("interval", 10*time.Millisecond, "pause between messages of one user (0 = as fast as possible)")
+	Prefix    = flag.String("prefix", "u", "username prefix (change it to start from fresh users)")
+	Timeout   = flag.Duration("timeout", 30*time.Second, "how long to wait for outstanding acks and deliveries")
 )
 
 type AuthResponse struct {
@@ -28,27 +36,108 @@ type ConversationResponse struct {
 	ID int `json:"conversation_id"`
 }
 
+// frame is the part of a server frame we look at
+type frame struct {
+	Type string `json:"type"`
+	Ref  string `json:"ref"`
+	Data struct {
+		ClientMsgID string `json:"client_msg_id"`
+		Code        string `json:"code"`
+	} `json:"data"`
+}
+
+// stats is shared by every connection
+type stats struct {
+	sent, acked, delivered, busy, failed atomic.Int64
+	lastEvent                            atomic.Int64 // UnixNano of the last ack/delivery
+
+	sentAt sync.Map // client_msg_id -> time.Time
+
+	mu         sync.Mutex
+	ackLat     []time.Duration
+	deliverLat []time.Duration
+}
+
+func (s *stats) record(lat *[]time.Duration, d time.Duration) {
+	s.mu.Lock()
+	*lat = append(*lat, d)
+	s.mu.Unlock()
+	s.lastEvent.Store(time.Now().UnixNano())
+}
+
+// chatter is one connected user, ready to send into its conversation
+type chatter struct {
+	user   string
+	convID int
+	conn   *websocket.Conn
+}
+
 func main() {
-	log.Printf("🔥 STARTING STRESS TEST: %d Users, %d Messages each...", UserCount*2, MsgCount)
-	var wg sync.WaitGroup
+	flag.Parse()
+	log.Printf("🔥 STARTING STRESS TEST: %d Users, %d Messages each...", *UserCount*2, *MsgCount)
+	st := &stats{}
 
-	// We will create pairs: User 0 talks to User 1, User 2 talks to User 3...
-	for i := 0; i < UserCount; i++ {
+	// 1. Setup: users, conversations and connections, before anyone sends,
+	// so every message has a live receiver and setup doesn't count as throughput
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		chatters []*chatter
+	)
+	for i := 0; i < *UserCount; i++ {
 		wg.Add(1)
 		go func(pairID int) {
 			defer wg.Done()
-			runPair(pairID)
+			pair := setupPair(pairID, st)
+			mu.Lock()
+			chatters = append(chatters, pair...)
+			mu.Unlock()
 		}(i)
 	}
+	wg.Wait()
+	if len(chatters) == 0 {
+		log.Fatal("❌ No users connected")
+	}
+	log.Printf("✅ %d users connected, sending...", len(chatters))
 
+	// 2. Spam: everyone at once
+	start := time.Now()
+	for _, c := range chatters {
+		wg.Add(1)
+		go func(c *chatter) {
+			defer wg.Done()
+			spamChat(c, st)
+		}(c)
+	}
 	wg.Wait()
+	sendTime := time.Since(start)
+
+	// 3. Wait for the stragglers: every message acked (or failed) and delivered to the peer
+	expected := st.sent.Load()
+	deadline := time.Now().Add(*Timeout)
+	for time.Now().Before(deadline) {
+		if st.acked.Load()+st.busy.Load()+st.failed.Load() >= expected && st.delivered.Load() >= st.acked.Load() {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	for _, c := range chatters {
+		c.conn.Close()
+	}
+
+	elapsed := time.Duration(st.lastEvent.Load() - start.UnixNano())
+	if elapsed <= 0 {
+		elapsed = sendTime
+	}
+	report(st, expected, sendTime, elapsed)
 	log.Println("✅ LOAD TEST COMPLETE")
 }
 
-func runPair(pairID int) {
-	// 1. Define Users (e.g., user_0_a, user_0_b)
-	userA := fmt.Sprintf("u_%d_a", pairID)
-	userB := fmt.Sprintf("u_%d_b", pairID)
+// setupPair registers both users, starts their chat and connects both.
+func setupPair(pairID int, st *stats) []*chatter {
+	// 1. Define Users (e.g., u_0_a, u_0_b)
+	userA := fmt.Sprintf("%s_%d_a", *Prefix, pairID)
+	userB := fmt.Sprintf("%s_%d_b", *Prefix, pairID)
 	pass := "password123"
 
 	// 2. Register & Login
@@ -56,29 +145,92 @@ func runPair(pairID int) {
 	tokenB, idB := authenticate(userB, pass)
 
 	if tokenA == "" || tokenB == "" {
-		return // Failed auth
+		return nil // Failed auth
 	}
 
 	// 3. User A starts conversation with User B
 	convID := createConversation(tokenA, idB)
 	if convID == 0 {
-		return
+		return nil
+	}
+
+	// 4. Connect both sides
+	a := connect(tokenA, userA, convID, st)
+	b := connect(tokenB, userB, convID, st)
+	if a == nil || b == nil {
+		for _, c := range []*chatter{a, b} {
+			if c != nil {
+				c.conn.Close()
+			}
+		}
+		return nil
+	}
+	return []*chatter{a, b}
+}
+
+// connect opens a user's WebSocket and starts reading its frames.
+func connect(token, user string, convID int, st *stats) *chatter {
+	conn, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("%s?token=%s", *WSURL, token), nil)
+	if err != nil {
+		log.Printf("❌ WS Connect Fail [%s]: %v", user, err)
+		return nil
 	}
+	c := &chatter{user: user, convID: convID, conn: conn}
+	go readFrames(c, st)
+	return c
+}
 
-	// 4. Start WebSocket Spam (Both sides)
-	var wsWg sync.WaitGroup
-	wsWg.Add(2)
+// readFrames times acks of our own messages and deliveries of the peer's.
+func readFrames(c *chatter, st *stats) {
+	for {
+		_, raw, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		// The server batches queued frames into one message, one per line
+		for _, line := range bytes.Split(raw, []byte("\n")) {
+			handleFrame(c, st, line)
+		}
+	}
+}
 
-	go spamChat(&wsWg, tokenA, convID, userA)
-	go spamChat(&wsWg, tokenB, convID, userB)
+// handleFrame counts one server frame.
+func handleFrame(c *chatter, st *stats, line []byte) {
+	var f frame
+	if json.Unmarshal(line, &f) != nil {
+		return
+	}
 
-	wsWg.Wait()
+	switch f.Type {
+	case "ack":
+		if sentAt, ok := st.sentAt.Load(f.Ref); ok {
+			st.acked.Add(1)
+			st.record(&st.ackLat, time.Since(sentAt.(time.Time)))
+		}
+	case "message":
+		// Our own message echoed back is not a delivery
+		if strings.HasPrefix(f.Data.ClientMsgID, c.user+"-") {
+			return
+		}
+		if sentAt, ok := st.sentAt.Load(f.Data.ClientMsgID); ok {
+			st.delivered.Add(1)
+			st.record(&st.deliverLat, time.Since(sentAt.(time.Time)))
+		}
+	case "error":
+		if f.Data.Code == "busy" {
+			st.busy.Add(1)
+		} else {
+			st.failed.Add(1)
+		}
+	}
 }
 
 // authenticate registers (ignores error if exists) and logs in
 func authenticate(username, password string) (string, int) {
 	// Register (Ignore error, might already exist)
-	postJSON("/register", map[string]string{"username": username, "password": password})
+	if resp, err := postJSON("/register", map[string]string{"username": username, "password": password}); err == nil {
+		resp.Body.Close()
+	}
 
 	// Login
 	resp, err := postJSON("/login", map[string]string{"username": username, "password": password})
@@ -99,7 +251,7 @@ func authenticate(username, password string) (string, int) {
 
 // searchUserID finds the user ID by username
 func searchUserID(token, username string) int {
-	req, _ := http.NewRequest("GET", fmt.Sprintf("%s/api/users/search?q=%s", BaseURL, username), nil)
+	req, _ := http.NewRequest("GET", fmt.Sprintf("%s/api/users/search?q=%s", *BaseURL, username), nil)
 	req.Header.Set("Authorization", "Bearer "+token)
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
@@ -124,51 +276,77 @@ func searchUserID(token, username string) int {
 func createConversation(token string, targetID int) int {
 	body := map[string]int{"target_id": targetID}
 	jsonBody, _ := json.Marshal(body)
-	req, _ := http.NewRequest("POST", BaseURL+"/api/conversations", bytes.NewBuffer(jsonBody))
+	req, _ := http.NewRequest("POST", *BaseURL+"/api/conversations", bytes.NewBuffer(jsonBody))
 	req.Header.Set("Authorization", "Bearer "+token)
 	req.Header.Set("Content-Type", "application/json")
 
 	resp, err := http.DefaultClient.Do(req)
-	if err != nil || resp.StatusCode != 200 {
+	if err != nil {
 		log.Printf("❌ Create Chat Failed: %v", err)
 		return 0
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("❌ Create Chat Failed: HTTP %d", resp.StatusCode)
+		return 0
+	}
 
 	var data ConversationResponse
 	json.NewDecoder(resp.Body).Decode(&data)
 	return data.ID
 }
 
-func spamChat(wg *sync.WaitGroup, token string, convID int, user string) {
-	defer wg.Done()
-
-	// Connect WS
-	conn, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("%s?token=%s", WSURL, token), nil)
-	if err != nil {
-		log.Printf("❌ WS Connect Fail [%s]: %v", user, err)
-		return
-	}
-	defer conn.Close()
-
+func spamChat(c *chatter, st *stats) {
 	// Spam Loop
-	for i := 0; i < MsgCount; i++ {
+	for i := 0; i < *MsgCount; i++ {
+		// The client_msg_id doubles as the ack ref, so both can be timed
+		id := fmt.Sprintf("%s-%d-%d", c.user, i, time.Now().UnixNano())
 		msg := map[string]interface{}{
-			"conversation_id": convID,
-			"content":         fmt.Sprintf("LoadTest Msg %d from %s", i, user),
+			"v":    1,
+			"type": "message",
+			"ref":  id,
+			"data": map[string]interface{}{
+				"conversation_id": c.convID,
+				"content":         fmt.Sprintf("LoadTest Msg %d from %s", i, c.user),
+				"client_msg_id":   id,
+			},
 		}
-		err := conn.WriteJSON(msg)
-		if err != nil {
-			log.Printf("❌ Send Fail [%s]: %v", user, err)
+		st.sentAt.Store(id, time.Now())
+		if err := c.conn.WriteJSON(msg); err != nil {
+			st.sentAt.Delete(id)
+			log.Printf("❌ Send Fail [%s]: %v", c.user, err)
 			break
 		}
+		st.sent.Add(1)
 		// Small sleep to prevent instant localhost bottleneck (simulate real network)
-		time.Sleep(10 * time.Millisecond)
+		if *Interval > 0 {
+			time.Sleep(*Interval)
+		}
 	}
-	log.Printf("✅ %s finished sending %d msgs", user, MsgCount)
 }
 
 func postJSON(endpoint string, data interface{}) (*http.Response, error) {
 	jsonData, _ := json.Marshal(data)
-	return http.Post(BaseURL+endpoint, "application/json", bytes.NewBuffer(jsonData))
+	return http.Post(*BaseURL+endpoint, "application/json", bytes.NewBuffer(jsonData))
+}
+
+// report prints throughput and latency percentiles.
+func report(st *stats, sent int64, sendTime, elapsed time.Duration) {
+	log.Printf("📊 Sent %d in %s, last ack/delivery after %s", sent, sendTime.Round(time.Millisecond), elapsed.Round(time.Millisecond))
+	log.Printf("📊 Acked %d, delivered %d, busy %d, failed %d", st.acked.Load(), st.delivered.Load(), st.busy.Load(), st.failed.Load())
+	log.Printf("📊 Throughput: %.0f msg/s sent, %.0f msg/s delivered",
+		float64(sent)/sendTime.Seconds(), float64(st.delivered.Load())/elapsed.Seconds())
+	log.Printf("📊 Ack latency:      %s", percentiles(st.ackLat))
+	log.Printf("📊 Delivery latency: %s", percentiles(st.deliverLat))
+}
+
+func percentiles(lat []time.Duration) string {
+	if len(lat) == 0 {
+		return "n/a"
+	}
+	slices.Sort(lat)
+	at := func(p float64) time.Duration {
+		return lat[int(p*float64(len(lat)-1))].Round(time.Microsecond)
+	}
+	return fmt.Sprintf("p50 %s  p95 %s  p99 %s  max %s", at(0.50), at(0.95), at(0.99), lat[len(lat)-1].Round(time.Microsecond))
 }